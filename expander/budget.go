@@ -0,0 +1,103 @@
+package expander
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BudgetUsage reports what a single expansion used of its budget.
+type BudgetUsage struct {
+	Fetches int           // remote fetches, cache hits are not counted
+	Bytes   int64         // bytes of the fetched resources
+	Elapsed time.Duration // wall-clock time of the whole expansion
+	Skipped int           // references left unexpanded because a limit was reached
+}
+
+// budget tracks the limits of a single Expand call, a zero limit means unlimited.
+type budget struct {
+	maxFetches int
+	maxBytes   int64
+	started    time.Time
+	deadline   time.Time
+
+	mutex   sync.Mutex
+	fetches int
+	bytes   int64
+	skipped int
+}
+
+func (e *Expander) newBudget() *budget {
+	b := &budget{
+		maxFetches: e.config.MaxFetches,
+		maxBytes:   e.config.MaxBytes,
+		started:    time.Now(),
+	}
+	if e.config.ExpansionTimeoutInMs > 0 {
+		b.deadline = b.started.Add(time.Duration(e.config.ExpansionTimeoutInMs) * time.Millisecond)
+	}
+
+	return b
+}
+
+// withDeadline derives the context the fetches of the expansion run with.
+func (b *budget) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.deadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithDeadline(ctx, b.deadline)
+}
+
+func (b *budget) deadlinePassed() bool {
+	return !b.deadline.IsZero() && !time.Now().Before(b.deadline)
+}
+
+// reserve takes one fetch from the budget. It returns the reason of the stop
+// if a limit is already reached. The byte limit is only checked up front, so
+// the last fetch can go over it.
+func (b *budget) reserve() (string, bool) {
+	if b.deadlinePassed() {
+		b.skip()
+		return STOPPED_BY_DEADLINE, false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.maxFetches > 0 && b.fetches >= b.maxFetches {
+		b.skipped++
+		return STOPPED_BY_MAX_FETCHES, false
+	}
+	if b.maxBytes > 0 && b.bytes >= b.maxBytes {
+		b.skipped++
+		return STOPPED_BY_MAX_BYTES, false
+	}
+
+	b.fetches++
+	return "", true
+}
+
+func (b *budget) addBytes(n int) {
+	b.mutex.Lock()
+	b.bytes += int64(n)
+	b.mutex.Unlock()
+}
+
+func (b *budget) skip() {
+	b.mutex.Lock()
+	b.skipped++
+	b.mutex.Unlock()
+}
+
+func (b *budget) usage() BudgetUsage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return BudgetUsage{
+		Fetches: b.fetches,
+		Bytes:   b.bytes,
+		Elapsed: time.Since(b.started),
+		Skipped: b.skipped,
+	}
+}
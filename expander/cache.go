@@ -0,0 +1,306 @@
+package expander
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// Cache stores the content of fetched references. Entries are dropped by the
+// cache itself once their ttl passed, a ttl <= 0 keeps them until evicted.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+}
+
+// PrefixDeleter is implemented by Caches that can drop all the entries whose
+// key starts with prefix.
+type PrefixDeleter interface {
+	DeletePrefix(prefix string)
+}
+
+// Purger is implemented by Caches that can drop all their entries at once.
+type Purger interface {
+	Purge()
+}
+
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func newCacheEntry(value []byte, ttl time.Duration) cacheEntry {
+	entry := cacheEntry{value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	return entry
+}
+
+func (entry cacheEntry) expired(now time.Time) bool {
+	return !entry.expires.IsZero() && !now.Before(entry.expires)
+}
+
+// LRUCache keeps at most size entries in memory and evicts the least
+// recently used one first.
+type LRUCache struct {
+	mutex sync.Mutex
+	lru   *lru.Cache
+	keys  map[string]struct{}
+
+	removing    bool
+	bytes       int64
+	evictions   int64
+	expirations int64
+}
+
+func NewLRUCache(size int) *LRUCache {
+	c := &LRUCache{
+		lru:  lru.New(size),
+		keys: make(map[string]struct{}),
+	}
+	c.lru.OnEvicted = func(key lru.Key, value interface{}) {
+		delete(c.keys, key.(string))
+		c.bytes -= int64(len(value.(cacheEntry).value))
+		if !c.removing {
+			c.evictions++
+		}
+	}
+
+	return c
+}
+
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	entry := value.(cacheEntry)
+	if entry.expired(time.Now()) {
+		c.expirations++
+		c.remove(key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+func (c *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if old, ok := c.lru.Get(key); ok {
+		c.bytes -= int64(len(old.(cacheEntry).value))
+	}
+	c.lru.Add(key, newCacheEntry(value, ttl))
+	c.keys[key] = struct{}{}
+	c.bytes += int64(len(value))
+}
+
+func (c *LRUCache) Delete(key string) {
+	c.mutex.Lock()
+	c.remove(key)
+	c.mutex.Unlock()
+}
+
+func (c *LRUCache) DeletePrefix(prefix string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.keys {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(key)
+		}
+	}
+}
+
+func (c *LRUCache) Purge() {
+	c.mutex.Lock()
+	c.removing = true
+	c.lru.Clear()
+	c.removing = false
+	c.mutex.Unlock()
+}
+
+// remove drops key without counting it as an eviction.
+func (c *LRUCache) remove(key string) {
+	c.removing = true
+	c.lru.Remove(key)
+	c.removing = false
+}
+
+func (c *LRUCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *LRUCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+		Entries:     c.lru.Len(),
+		Bytes:       c.bytes,
+	}
+}
+
+// SWEEP_EVERY_SETS is how often a shard of a ShardedCache drops its expired entries.
+const SWEEP_EVERY_SETS = 256
+
+// ShardedCache spreads its entries over several maps with their own lock, so
+// concurrent expansions rarely wait for each other. It has no size limit.
+type ShardedCache struct {
+	shards []*cacheShard
+}
+
+type cacheShard struct {
+	mutex       sync.RWMutex
+	entries     map[string]cacheEntry
+	sets        int
+	bytes       int64
+	expirations int64
+}
+
+func NewShardedCache(shards int) *ShardedCache {
+	if shards <= 0 {
+		shards = 1
+	}
+
+	c := &ShardedCache{shards: make([]*cacheShard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{entries: make(map[string]cacheEntry)}
+	}
+
+	return c
+}
+
+func (c *ShardedCache) shard(key string) *cacheShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return c.shards[hash.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *ShardedCache) Get(key string) ([]byte, bool) {
+	shard := c.shard(key)
+
+	shard.mutex.RLock()
+	entry, ok := shard.entries[key]
+	shard.mutex.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+	if entry.expired(time.Now()) {
+		shard.mutex.Lock()
+		// it may have been set again in the meantime
+		if entry, ok := shard.entries[key]; ok && entry.expired(time.Now()) {
+			shard.expirations++
+			shard.remove(key)
+		}
+		shard.mutex.Unlock()
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+func (c *ShardedCache) Set(key string, value []byte, ttl time.Duration) {
+	shard := c.shard(key)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	shard.remove(key)
+	shard.entries[key] = newCacheEntry(value, ttl)
+	shard.bytes += int64(len(value))
+	shard.sets++
+	if shard.sets%SWEEP_EVERY_SETS == 0 {
+		shard.sweep()
+	}
+}
+
+func (c *ShardedCache) Delete(key string) {
+	shard := c.shard(key)
+
+	shard.mutex.Lock()
+	shard.remove(key)
+	shard.mutex.Unlock()
+}
+
+func (c *ShardedCache) DeletePrefix(prefix string) {
+	for _, shard := range c.shards {
+		shard.mutex.Lock()
+		for key := range shard.entries {
+			if strings.HasPrefix(key, prefix) {
+				shard.remove(key)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+func (c *ShardedCache) Purge() {
+	for _, shard := range c.shards {
+		shard.mutex.Lock()
+		shard.entries = make(map[string]cacheEntry)
+		shard.bytes = 0
+		shard.mutex.Unlock()
+	}
+}
+
+func (c *ShardedCache) Len() int {
+	length := 0
+	for _, shard := range c.shards {
+		shard.mutex.RLock()
+		length += len(shard.entries)
+		shard.mutex.RUnlock()
+	}
+
+	return length
+}
+
+// Stats of a ShardedCache never count evictions, as it has no size limit.
+func (c *ShardedCache) Stats() CacheStats {
+	var stats CacheStats
+	for _, shard := range c.shards {
+		shard.mutex.RLock()
+		stats.Expirations += shard.expirations
+		stats.Entries += len(shard.entries)
+		stats.Bytes += shard.bytes
+		shard.mutex.RUnlock()
+	}
+
+	return stats
+}
+
+func (shard *cacheShard) remove(key string) {
+	if entry, ok := shard.entries[key]; ok {
+		shard.bytes -= int64(len(entry.value))
+		delete(shard.entries, key)
+	}
+}
+
+func (shard *cacheShard) sweep() {
+	now := time.Now()
+	for key, entry := range shard.entries {
+		if entry.expired(now) {
+			shard.expirations++
+			shard.remove(key)
+		}
+	}
+}
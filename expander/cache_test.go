@@ -0,0 +1,146 @@
+package expander
+
+import (
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+
+	caches := map[string]func() Cache{
+		"LRUCache":     func() Cache { return NewLRUCache(10) },
+		"ShardedCache": func() Cache { return NewShardedCache(4) },
+		"FileCache": func() Cache {
+			cache, _ := NewFileCache(t.TempDir())
+			return cache
+		},
+	}
+
+	for name, newCache := range caches {
+		Convey(fmt.Sprintf("%v should store the content of references until their ttl passed:", name), t, func() {
+				cache := newCache()
+
+				Convey("Getting a key that was set should return its value", func() {
+						cache.Set("http://valid", []byte("data"), time.Minute)
+						value, ok := cache.Get("http://valid")
+
+						So(ok, ShouldBeTrue)
+						So(string(value), ShouldEqual, "data")
+					})
+
+				Convey("Getting a key that was never set should return nothing", func() {
+						_, ok := cache.Get("http://unknown")
+
+						So(ok, ShouldBeFalse)
+					})
+
+				Convey("Getting a key after its ttl passed should return nothing", func() {
+						cache.Set("http://valid", []byte("data"), time.Millisecond)
+						time.Sleep(2 * time.Millisecond)
+						_, ok := cache.Get("http://valid")
+
+						So(ok, ShouldBeFalse)
+					})
+
+				Convey("Getting a key without a ttl should return its value", func() {
+						cache.Set("http://valid", []byte("data"), 0)
+						_, ok := cache.Get("http://valid")
+
+						So(ok, ShouldBeTrue)
+					})
+
+				Convey("Getting a deleted key should return nothing", func() {
+						cache.Set("http://valid", []byte("data"), time.Minute)
+						cache.Delete("http://valid")
+						_, ok := cache.Get("http://valid")
+
+						So(ok, ShouldBeFalse)
+					})
+
+				Convey("Deleting by prefix should drop only the keys starting with it", func() {
+						cache.Set("http://contacts/1", []byte("data"), time.Minute)
+						cache.Set("http://contacts/2", []byte("data"), time.Minute)
+						cache.Set("http://groups/1", []byte("data"), time.Minute)
+						cache.(PrefixDeleter).DeletePrefix("http://contacts/")
+
+						_, firstCached := cache.Get("http://contacts/1")
+						_, secondCached := cache.Get("http://contacts/2")
+						_, groupCached := cache.Get("http://groups/1")
+
+						So(firstCached, ShouldBeFalse)
+						So(secondCached, ShouldBeFalse)
+						So(groupCached, ShouldBeTrue)
+					})
+
+				Convey("Purging should drop every key and keep the cache usable", func() {
+						cache.Set("http://contacts/1", []byte("data"), time.Minute)
+						cache.(Purger).Purge()
+						_, purged := cache.Get("http://contacts/1")
+
+						cache.Set("http://contacts/1", []byte("data"), time.Minute)
+						_, cachedAgain := cache.Get("http://contacts/1")
+
+						So(purged, ShouldBeFalse)
+						So(cachedAgain, ShouldBeTrue)
+					})
+			})
+	}
+
+	Convey("LRUCache should evict the least recently used entry when it is full:", t, func() {
+			cache := NewLRUCache(2)
+			cache.Set("http://first", []byte("1"), time.Minute)
+			cache.Set("http://second", []byte("2"), time.Minute)
+			cache.Get("http://first")
+			cache.Set("http://third", []byte("3"), time.Minute)
+
+			_, firstCached := cache.Get("http://first")
+			_, secondCached := cache.Get("http://second")
+
+			So(cache.Len(), ShouldEqual, 2)
+			So(firstCached, ShouldBeTrue)
+			So(secondCached, ShouldBeFalse)
+		})
+
+	Convey("LRUCache should count evictions, expirations and bytes:", t, func() {
+			cache := NewLRUCache(2)
+			cache.Set("http://first", []byte("1"), time.Minute)
+			cache.Set("http://second", []byte("22"), time.Millisecond)
+			cache.Set("http://first", []byte("333"), time.Minute)
+			cache.Set("http://third", []byte("4444"), time.Minute)
+			cache.Set("http://fourth", []byte("55555"), time.Minute)
+			cache.Delete("http://fourth")
+
+			So(cache.Stats(), ShouldResemble, CacheStats{Evictions: 2, Entries: 1, Bytes: 4})
+
+			cache.Set("http://expiring", []byte("data"), time.Millisecond)
+			time.Sleep(2 * time.Millisecond)
+			cache.Get("http://expiring")
+
+			So(cache.Stats().Expirations, ShouldEqual, 1)
+		})
+
+	Convey("ShardedCache should count expirations and bytes:", t, func() {
+			cache := NewShardedCache(4)
+			cache.Set("http://first", []byte("1"), time.Minute)
+			cache.Set("http://first", []byte("333"), time.Minute)
+			cache.Set("http://expiring", []byte("data"), time.Millisecond)
+			time.Sleep(2 * time.Millisecond)
+			cache.Get("http://expiring")
+
+			So(cache.Stats(), ShouldResemble, CacheStats{Expirations: 1, Entries: 1, Bytes: 3})
+		})
+
+	Convey("ShardedCache should drop expired entries of a shard while setting new ones:", t, func() {
+			cache := NewShardedCache(1)
+			cache.Set("http://expiring", []byte("data"), time.Millisecond)
+			time.Sleep(2 * time.Millisecond)
+
+			for i := 1; i < SWEEP_EVERY_SETS; i++ {
+				cache.Set(fmt.Sprintf("http://valid/%v", i), []byte("data"), time.Minute)
+			}
+
+			So(cache.Len(), ShouldEqual, SWEEP_EVERY_SETS-1)
+		})
+}
@@ -0,0 +1,126 @@
+package expander
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cachedResource is what the Expander stores in its Cache for a reference.
+// It outlives its freshness when it can be revalidated.
+type cachedResource struct {
+	Content      json.RawMessage
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	FreshUntil   time.Time
+	Failure      *cachedFailure `json:",omitempty"`
+}
+
+// cachedFailure is the last failed lookup of a cached resource.
+type cachedFailure struct {
+	StatusCode int `json:",omitempty"`
+	Message    string
+	Until      time.Time
+}
+
+// failedRecently returns the cached failure of r, if it did not expire yet.
+func (r *cachedResource) failedRecently(ref Reference, now time.Time) error {
+	if r == nil || r.Failure == nil || !now.Before(r.Failure.Until) {
+		return nil
+	}
+
+	return &FetchError{URI: ref.Ref, StatusCode: r.Failure.StatusCode, Err: fmt.Errorf("%w: %v", ErrCachedFailure, r.Failure.Message)}
+}
+
+func (r *cachedResource) fresh(now time.Time) bool {
+	return now.Before(r.FreshUntil)
+}
+
+// staleWithin tells if r expired no longer than window ago.
+func (r *cachedResource) staleWithin(now time.Time, window time.Duration) bool {
+	return window > 0 && !now.After(r.FreshUntil.Add(window))
+}
+
+func (r *cachedResource) validators() Validators {
+	if r == nil {
+		return Validators{}
+	}
+
+	return Validators{ETag: r.ETag, LastModified: r.LastModified}
+}
+
+func (r *cachedResource) revalidatable() bool {
+	return r.ETag != "" || r.LastModified != ""
+}
+
+// cachePolicy is what the caching headers of a response allow.
+type cachePolicy struct {
+	noStore  bool
+	freshFor time.Duration
+}
+
+// cachePolicyOf reads Cache-Control and Expires. Responses without them are
+// fresh for fallback. As the cache is shared by all callers, private responses
+// are not stored.
+func cachePolicyOf(header http.Header, fallback time.Duration, now time.Time) cachePolicy {
+	directives := cacheControlDirectives(header.Get("Cache-Control"))
+
+	if _, ok := directives["no-store"]; ok {
+		return cachePolicy{noStore: true}
+	}
+	if _, ok := directives["private"]; ok {
+		return cachePolicy{noStore: true}
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return cachePolicy{}
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return cachePolicy{}
+			}
+			return cachePolicy{freshFor: time.Duration(seconds) * time.Second}
+		}
+	}
+
+	if expiresHeader := header.Get("Expires"); expiresHeader != "" {
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil {
+			// an invalid Expires means already expired
+			return cachePolicy{}
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		if expires.Before(now) {
+			return cachePolicy{}
+		}
+		return cachePolicy{freshFor: expires.Sub(now)}
+	}
+
+	return cachePolicy{freshFor: fallback}
+}
+
+func cacheControlDirectives(cacheControl string) map[string]string {
+	directives := make(map[string]string)
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+
+		name, value := directive, ""
+		if i := strings.Index(directive, "="); i >= 0 {
+			name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+		}
+		directives[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+
+	return directives
+}
@@ -0,0 +1,104 @@
+package expander
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrMongoWithoutIdURIs = errors.New("cannot use mongo flag without proper IdURIs given")
+var ErrCacheWithoutExpiration = errors.New("cannot use cache with expiration 0, cache will be useless")
+var ErrNotJSON = errors.New("response is not JSON")
+var ErrCachedFailure = errors.New("failed recently")
+var ErrVerbNotAllowed = errors.New("verb is not allowed")
+var ErrCircuitOpen = errors.New("circuit breaker of the host is open")
+
+// ErrorPolicy decides what happens to a link that could not be resolved.
+type ErrorPolicy int
+
+const (
+	KEEP_LINK ErrorPolicy = iota
+	REPLACE_WITH_NULL
+	EMBED_ERROR // {ref, status, message} instead of the resource
+	FAIL_EXPANSION
+)
+
+type FilterSyntaxError struct {
+	Filter   string
+	Position int    // byte offset of the offending token
+	Expected string // the token(s) expected there
+	Message  string
+}
+
+func (e *FilterSyntaxError) Error() string {
+	return fmt.Sprintf("filter '%v' is not correct at position %v: %v", e.Filter, e.Position, e.Message)
+}
+
+type FetchError struct {
+	URI        string
+	StatusCode int
+	Err        error
+}
+
+func (e *FetchError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("fetching '%v' failed with status %v: %v", e.URI, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("fetching '%v' failed: %v", e.URI, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+type DecodeError struct {
+	URI string
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if e.URI == "" {
+		return fmt.Sprintf("decoding failed: %v", e.Err)
+	}
+	return fmt.Sprintf("decoding '%v' failed: %v", e.URI, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// ExpansionErrors collects every partial failure of a single expansion.
+type ExpansionErrors []error
+
+func (errs ExpansionErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%v error(s) during expansion: %v", len(errs), strings.Join(messages, "; "))
+}
+
+func (errs ExpansionErrors) Unwrap() []error {
+	return errs
+}
+
+// messageOf returns the message of the cause of err, without the URI.
+func messageOf(err error) string {
+	if cause := errors.Unwrap(err); cause != nil {
+		return cause.Error()
+	}
+
+	return err.Error()
+}
+
+// statusOf returns the status code of the response err was caused by, 0 if
+// there was none.
+func statusOf(err error) int {
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr.StatusCode
+	}
+
+	return 0
+}
@@ -1,20 +1,21 @@
 package expander
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"net"
-	"errors"
 
-	"github.com/golang/groupcache/lru"
+	"github.com/golang/groupcache/singleflight"
 )
 
 const (
@@ -22,46 +23,237 @@ const (
 	REL_KEY        = "rel"
 	VERB_KEY       = "verb"
 	COLLECTION_KEY = "Collection"
+	STOPPED_KEY    = "expansionStopped"
+	STATUS_KEY     = "status"
+	MESSAGE_KEY    = "message"
+
+	STOPPED_BY_CYCLE       = "cycle"
+	STOPPED_BY_MAX_DEPTH   = "max-depth"
+	STOPPED_BY_MAX_FETCHES = "max-fetches"
+	STOPPED_BY_MAX_BYTES   = "max-bytes"
+	STOPPED_BY_DEADLINE    = "deadline"
+
+	DESCENDANTS = "**" // matches its children at any depth, e.g. **.city
+
+	DEFAULT_CACHE_SIZE             = 250
+	DEFAULT_MAX_CONCURRENT_FETCHES = 8
+	DEFAULT_MAX_EXPANSION_DEPTH    = 10
 )
 
 type Configuration struct {
 	UsingCache           bool
 	UsingMongo           bool
-	IdURIs            map[string]string
+	IdURIs               map[string]string
 	CacheExpInSeconds    int64
 	ConnectionTimeoutInS int
+	MaxConcurrentFetches int   // per Expand call, DEFAULT_MAX_CONCURRENT_FETCHES if not set
+	MaxExpansionDepth    int   // nested references per branch, DEFAULT_MAX_EXPANSION_DEPTH if not set
+	MaxFetches           int   // remote fetches per Expand call, unlimited if not set
+	MaxBytes             int64 // fetched bytes per Expand call, unlimited if not set
+	ExpansionTimeoutInMs int   // wall-clock time per Expand call, unlimited if not set
+
+	// ErrorPolicies by status class, e.g. 4 for 4xx and 0 for failures without
+	// a status like network errors, KEEP_LINK if not set
+	ErrorPolicies map[int]ErrorPolicy
+
+	// how long expired entries with an ETag or Last-Modified are kept for
+	// conditional requests, CacheExpInSeconds if not set
+	CacheKeepStaleInSeconds int64
+
+	// how long expired entries are served right away while they are refreshed
+	// in the background, off if not set
+	CacheStaleWhileRevalidateInSeconds int64
+
+	// how long expired entries are served when refreshing them fails, off if
+	// not set
+	CacheStaleIfErrorInSeconds int64
+
+	// how long failed lookups are cached, so they are not fetched again on
+	// every expansion, off if not set
+	CacheFailuresForInSeconds int64
+
+	// inbound headers sent along with the fetches, see WithHeaders. The
+	// ForwardHeaders change the response (e.g. Authorization or a tenant) and
+	// are part of the cache key, the PassThroughHeaders (e.g. a correlation
+	// ID) are not
+	ForwardHeaders     []string
+	PassThroughHeaders []string
+
+	// hosts or URI prefixes the ForwardHeaders and PassThroughHeaders are
+	// sent to, like the keys of HostLimits, none if not set. Links in the data
+	// can point anywhere, e.g. to third parties.
+	ForwardHeadersTo []string
+
+	AllowedVerbs []string // besides GET, HEAD and OPTIONS, e.g. POST for search endpoints
+
+	// retries of idempotent fetches that failed with a network error, a
+	// timeout, 429 or 5xx, off if not set. The backoff doubles with each
+	// retry, starting at RetryBackoffInMs or DEFAULT_RETRY_BACKOFF_IN_MS
+	MaxRetries       int
+	RetryBackoffInMs int
+
+	// consecutive failures after which the fetches from a host fail fast for
+	// BreakerCooldownInMs (DEFAULT_BREAKER_COOLDOWN_IN_MS if not set), off if
+	// not set
+	BreakerFailureThreshold int
+	BreakerCooldownInMs     int
+
+	// limits of the fetches by host (e.g. "api.example.com:8080") or URI
+	// prefix (e.g. "http://api.example.com/search"). Fetches over a limit wait
+	// for their turn until the context of the expansion is done
+	HostLimits map[string]HostLimit
 }
 
-var ExpanderConfig Configuration = Configuration{
-	UsingMongo:        false,
-	UsingCache:        false,
-	CacheExpInSeconds: 86400, // = 24 hours
-	ConnectionTimeoutInS: 2,
-}
+var ExpanderConfig Configuration = defaultConfiguration()
+
+var DefaultCache Cache = NewLRUCache(DEFAULT_CACHE_SIZE)
+var flights = &singleflight.Group{}
+var defaultStats = &cacheStats{}
+var defaultBreakers = newBreakerGroup()
+var defaultLimiters = newLimiterGroup()
+var defaultRefreshes = &sync.Map{}
 
-var Cache *lru.Cache = lru.New(250)
-var CacheMutex = sync.Mutex{}
+// RequestHook changes the request of each reference fetched by the
+// package-level functions, see WithRequestHook.
+var RequestHook func(request *http.Request)
 var client http.Client
-var timeout = time.Duration(2 * time.Second)
 var httpClientIsInitialized = false
 var initializingHttpClient = false
 var initializerMutex = sync.Mutex{}
 
-func dialTimeout(network, addr string) (net.Conn, error) {
-	return net.DialTimeout(network, addr, timeout)
+func defaultConfiguration() Configuration {
+	return Configuration{
+		UsingMongo:           false,
+		UsingCache:           false,
+		CacheExpInSeconds:    86400, // = 24 hours
+		ConnectionTimeoutInS: 2,
+	}
 }
 
 func Init() {
 	client = http.Client{}
 
-	client.Timeout = time.Duration(ExpanderConfig.ConnectionTimeoutInS)*time.Second
+	client.Timeout = time.Duration(ExpanderConfig.ConnectionTimeoutInS) * time.Second
 
 	httpClientIsInitialized = true
 }
 
-type CacheEntry struct {
-	Timestamp int64
-	Data      string
+// Expander owns its configuration, fetcher and cache, so several of them
+// can live side by side in the same process.
+type Expander struct {
+	config    Configuration
+	client    *http.Client
+	fetcher   Fetcher
+	cache     Cache
+	flights   *singleflight.Group
+	stats     *cacheStats
+	breakers  *breakerGroup
+	limiters  *limiterGroup
+	refreshes *sync.Map // cache keys being refreshed in the background
+
+	requestHook  func(request *http.Request)
+	configErrors ExpansionErrors
+}
+
+type Option func(*Expander)
+
+func WithConfiguration(config Configuration) Option {
+	return func(e *Expander) {
+		e.config = config
+	}
+}
+
+func WithHTTPClient(client *http.Client) Option {
+	return func(e *Expander) {
+		e.client = client
+	}
+}
+
+// WithFetcher replaces the HTTP calls made for each reference, e.g. with
+// in-process handlers or fixtures.
+func WithFetcher(fetcher Fetcher) Option {
+	return func(e *Expander) {
+		e.fetcher = fetcher
+	}
+}
+
+// WithRequestHook lets hook change the request of each reference, e.g. to
+// sign it. The response may then depend on the request, so the fetches are
+// neither cached nor collapsed. It is not used with a Fetcher of your own.
+func WithRequestHook(hook func(request *http.Request)) Option {
+	return func(e *Expander) {
+		e.requestHook = hook
+	}
+}
+
+func WithCacheSize(size int) Option {
+	return func(e *Expander) {
+		e.cache = NewLRUCache(size)
+	}
+}
+
+// WithCache plugs in any Cache, e.g. a shared cache tier or the package-level
+// DefaultCache.
+func WithCache(cache Cache) Option {
+	return func(e *Expander) {
+		e.cache = cache
+	}
+}
+
+func New(options ...Option) *Expander {
+	e := &Expander{
+		config:    defaultConfiguration(),
+		flights:   &singleflight.Group{},
+		stats:     &cacheStats{},
+		breakers:  newBreakerGroup(),
+		limiters:  newLimiterGroup(),
+		refreshes: &sync.Map{},
+	}
+
+	for _, option := range options {
+		option(e)
+	}
+
+	if e.cache == nil {
+		e.cache = NewLRUCache(DEFAULT_CACHE_SIZE)
+	}
+	if e.client == nil {
+		e.client = &http.Client{Timeout: time.Duration(e.config.ConnectionTimeoutInS) * time.Second}
+	}
+	if e.fetcher == nil {
+		e.fetcher = &HTTPFetcher{Client: e.client, PrepareRequest: e.requestHook}
+	}
+
+	e.configErrors = validateConfiguration(e.config)
+
+	return e
+}
+
+// defaultExpander wraps the package-level globals, so Expand and ExpandArray
+// keep honoring ExpanderConfig and DefaultCache.
+func defaultExpander() *Expander {
+	if !httpClientIsInitialized {
+		initializerMutex.Lock()
+		if !initializingHttpClient {
+			initializingHttpClient = true
+			Init()
+		}
+		initializerMutex.Unlock()
+	}
+
+	return &Expander{
+		config:    ExpanderConfig,
+		client:    &client,
+		fetcher:   &HTTPFetcher{Client: &client, PrepareRequest: RequestHook},
+		cache:     DefaultCache,
+		flights:   flights,
+		stats:     defaultStats,
+		breakers:  defaultBreakers,
+		limiters:  defaultLimiters,
+		refreshes: defaultRefreshes,
+
+		configErrors: validateConfiguration(ExpanderConfig),
+	}
 }
 
 type DBRef struct {
@@ -76,14 +268,87 @@ type ObjectId interface {
 
 type Filter struct {
 	Children Filters
-	Value    string
+	Value    string // a field name, or a pattern with * like meta_*
+	Exclude  bool   // the field is dropped, e.g. -description
+	Depth    int    // levels a * goes down, e.g. *:2
 }
 
 type Filters []Filter
 
+// matches tells if the name or pattern of the filter matches the field v.
+// DESCENDANTS doesn't match a field itself, only through its children.
+func (f Filter) matches(v string) bool {
+	if f.Value == v {
+		return true
+	}
+	if f.Value == DESCENDANTS || !strings.Contains(f.Value, "*") {
+		return false
+	}
+
+	matched, _ := path.Match(f.Value, v)
+	return matched
+}
+
+// Contains tells if v is one of the fields named by the filters, by its
+// name, a pattern or under a DESCENDANTS filter. Excluded ones aside.
 func (m Filters) Contains(v string) bool {
 	for _, m := range m {
-		if v == m.Value {
+		if m.Exclude {
+			continue
+		}
+		if m.Value == DESCENDANTS && m.Children.Contains(v) || m.matches(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keeps tells if the field v passes the filters. Filters without exclusions
+// keep only the fields they name, those with an exclusion keep every field
+// but the excluded ones; the other fields they name only narrow down their
+// children.
+func (m Filters) Keeps(v string) bool {
+	excluding := false
+	for _, m := range m {
+		if m.Exclude {
+			if m.matches(v) {
+				return false
+			}
+			excluding = true
+		}
+	}
+
+	return m.IsEmpty() || excluding || m.Contains(v)
+}
+
+// expands tells if the link in the field v is to be fetched. Recursive
+// expansions fetch every link the filters might keep, like walkByFilter does;
+// without filters, that is every link.
+func (m Filters) expands(v string, recursive bool) bool {
+	if recursive {
+		return m.Keeps(v) || m.descends()
+	}
+
+	return m.Contains(v)
+}
+
+// excludes tells if the filters have an exclusion at any depth.
+func (m Filters) excludes() bool {
+	for _, m := range m {
+		if m.Exclude || m.Children.excludes() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// descends tells if the filters have a DESCENDANTS filter at their top level,
+// which might match any field below this one.
+func (m Filters) descends() bool {
+	for _, m := range m {
+		if m.Value == DESCENDANTS && !m.Exclude {
 			return true
 		}
 	}
@@ -95,6 +360,9 @@ func (m Filters) IsEmpty() bool {
 	return len(m) == 0
 }
 
+// Get returns the filter of the field v. A filter naming v wins over the
+// first pattern matching it. DESCENDANTS filters go down to the children of
+// every field, so they keep matching at any depth.
 func (m Filters) Get(v string) Filter {
 	var result Filter
 
@@ -103,45 +371,142 @@ func (m Filters) Get(v string) Filter {
 	}
 
 	for _, m := range m {
-		if v == m.Value {
-			return m
+		if m.Exclude || m.Value == DESCENDANTS {
+			continue
+		}
+		if m.Value == v {
+			result = m
+			break
+		}
+		if result.Value == "" && m.matches(v) {
+			result = m
+		}
+	}
+	if result.Depth > 1 {
+		result.Children = Filters{{Value: result.Value, Depth: result.Depth - 1}}
+	}
+
+	for _, m := range m {
+		if m.Exclude || m.Value != DESCENDANTS {
+			continue
+		}
+		if result.Value == "" && m.Children.Contains(v) {
+			result = m.Children.Get(v)
 		}
+		result.Children = append(result.Children[:len(result.Children):len(result.Children)], m)
 	}
 
 	return result
 }
 
 func resolveFilters(expansion, fields string) (expansionFilter Filters, fieldFilter Filters, recursiveExpansion bool, err error) {
-	if !validateFilterFormat(expansion) {
-		err = errors.New("expansionFilter for filtering was not correct")
+	if expansionFilter, err = buildFilterTree(expansion); err != nil {
 		return
 	}
-	if !validateFilterFormat(fields) {
-		err = errors.New("fieldFilter for filtering was not correct")
+	if fieldFilter, err = buildFilterTree(fields); err != nil {
 		return
 	}
 
-	fieldFilter, _ = buildFilterTree(fields)
-
-	if expansion != "*" {
-		expansionFilter, _ = buildFilterTree(expansion)
-	} else if fields != "*" && fields != "" {
-		expansionFilter, _ = buildFilterTree(fields)
-	} else {
+	// with exclusions, * expands everything the fields keep, at any depth,
+	// and nothing they drop, see expands
+	if expansion == "*" && fieldFilter.excludes() {
+		expansionFilter = fieldFilter
+		recursiveExpansion = true
+	} else if expansion == "*" && !fieldFilter.IsEmpty() {
+		expansionFilter = fieldFilter
+	} else if expansion == "*" {
 		recursiveExpansion = true
 	}
 	return
 }
 
-//TODO: TagFields & BSONFields
+// TODO: TagFields & BSONFields
 func Expand(data interface{}, expansion, fields string) map[string]interface{} {
-	if ExpanderConfig.UsingMongo && len(ExpanderConfig.IdURIs) == 0 {
-		fmt.Println("Warning: Cannot use mongo flag without proper IdURIs given!")
+	e := defaultExpander()
+	e.printConfigurationWarnings()
+	return e.Expand(data, expansion, fields)
+}
+
+func ExpandArray(data interface{}, expansion, fields string) []interface{} {
+	e := defaultExpander()
+	e.printConfigurationWarnings()
+	return e.ExpandArray(data, expansion, fields)
+}
+
+// ConfigurationErrors returns the problems of ExpanderConfig, nil if there
+// are none.
+func ConfigurationErrors() error {
+	return defaultExpander().ConfigurationErrors()
+}
+
+func ExpandE(data interface{}, expansion, fields string) (map[string]interface{}, error) {
+	return defaultExpander().ExpandE(data, expansion, fields)
+}
+
+func ExpandArrayE(data interface{}, expansion, fields string) ([]interface{}, error) {
+	return defaultExpander().ExpandArrayE(data, expansion, fields)
+}
+
+func ExpandContext(ctx context.Context, data interface{}, expansion, fields string) (map[string]interface{}, error) {
+	return defaultExpander().ExpandContext(ctx, data, expansion, fields)
+}
+
+func ExpandArrayContext(ctx context.Context, data interface{}, expansion, fields string) ([]interface{}, error) {
+	return defaultExpander().ExpandArrayContext(ctx, data, expansion, fields)
+}
+
+func ExpandWithUsage(ctx context.Context, data interface{}, expansion, fields string) (map[string]interface{}, BudgetUsage, error) {
+	return defaultExpander().ExpandWithUsage(ctx, data, expansion, fields)
+}
+
+func ExpandArrayWithUsage(ctx context.Context, data interface{}, expansion, fields string) ([]interface{}, BudgetUsage, error) {
+	return defaultExpander().ExpandArrayWithUsage(ctx, data, expansion, fields)
+}
+
+func validateConfiguration(config Configuration) ExpansionErrors {
+	var errs ExpansionErrors
+
+	if config.UsingMongo && len(config.IdURIs) == 0 {
+		errs = append(errs, ErrMongoWithoutIdURIs)
 	}
-	if ExpanderConfig.UsingCache && ExpanderConfig.CacheExpInSeconds == 0 {
-		fmt.Println("Warning: Cannot use Cache with expiration 0, cache will be useless!")
+	if config.UsingCache && config.CacheExpInSeconds == 0 {
+		errs = append(errs, ErrCacheWithoutExpiration)
 	}
 
+	return errs
+}
+
+// ConfigurationErrors returns the problems of the configuration the instance
+// was created with, nil if there are none. They are not expansion errors, so
+// ExpandE doesn't return them.
+func (e *Expander) ConfigurationErrors() error {
+	if len(e.configErrors) == 0 {
+		return nil
+	}
+
+	return e.configErrors
+}
+
+func (e *Expander) printConfigurationWarnings() {
+	if len(e.configErrors) > 0 {
+		printWarnings(e.configErrors)
+	}
+}
+
+func printWarnings(err error) {
+	errs, ok := err.(ExpansionErrors)
+	if !ok {
+		errs = ExpansionErrors{err}
+	}
+
+	for _, err := range errs {
+		fmt.Println("Warning:", err)
+	}
+}
+
+// Expand works like ExpandE, but falls back to the unfiltered data when the
+// filters are invalid and only prints the problems it runs into.
+func (e *Expander) Expand(data interface{}, expansion, fields string) map[string]interface{} {
 	expansionFilter, fieldFilter, recursiveExpansion, err := resolveFilters(expansion, fields)
 	if err != nil {
 		expansionFilter = Filters{}
@@ -149,21 +514,57 @@ func Expand(data interface{}, expansion, fields string) map[string]interface{} {
 		fmt.Printf("Warning: Filter was not correct, expansionFilter: '%v' fieldFilter: '%v', error: %v \n", expansion, fields, err)
 	}
 
-	expanded := *walkByExpansion(data, expansionFilter, recursiveExpansion)
+	result, _, err := e.expand(context.Background(), data, expansionFilter, fieldFilter, recursiveExpansion)
+	if err != nil {
+		printWarnings(err)
+	}
 
-	filtered := walkByFilter(expanded, fieldFilter)
+	return result
+}
 
-	return filtered
+// ExpandE returns a *FilterSyntaxError when the filters are invalid. Otherwise
+// it returns the expanded data together with an ExpansionErrors of all the
+// references that could not be resolved.
+func (e *Expander) ExpandE(data interface{}, expansion, fields string) (map[string]interface{}, error) {
+	return e.ExpandContext(context.Background(), data, expansion, fields)
 }
 
-func ExpandArray(data interface{}, expansion, fields string) []interface{} {
-	if ExpanderConfig.UsingMongo && len(ExpanderConfig.IdURIs) == 0 {
-		fmt.Println("Warning: Cannot use mongo flag without proper IdURIs given!")
+// ExpandContext works like ExpandE, but stops fetching references as soon as
+// ctx is done. References that were not fetched by then stay as they are.
+func (e *Expander) ExpandContext(ctx context.Context, data interface{}, expansion, fields string) (map[string]interface{}, error) {
+	result, _, err := e.ExpandWithUsage(ctx, data, expansion, fields)
+	return result, err
+}
+
+// ExpandWithUsage works like ExpandContext and also reports how much of the
+// fetch budget of the configuration the expansion used. References that were
+// skipped because a limit was reached stay as links, marked with the limit.
+func (e *Expander) ExpandWithUsage(ctx context.Context, data interface{}, expansion, fields string) (map[string]interface{}, BudgetUsage, error) {
+	expansionFilter, fieldFilter, recursiveExpansion, err := resolveFilters(expansion, fields)
+	if err != nil {
+		return nil, BudgetUsage{}, err
 	}
-	if ExpanderConfig.UsingCache && ExpanderConfig.CacheExpInSeconds == 0 {
-		fmt.Println("Warning: Cannot use Cache with expiration 0, cache will be useless!")
+
+	return e.expand(ctx, data, expansionFilter, fieldFilter, recursiveExpansion)
+}
+
+func (e *Expander) expand(ctx context.Context, data interface{}, expansionFilter, fieldFilter Filters, recursive bool) (map[string]interface{}, BudgetUsage, error) {
+	w := e.newWalker()
+	walkCtx, cancel := w.budget.withDeadline(e.withOutboundHeaders(ctx))
+	defer cancel()
+	w.cancel = cancel
+
+	expanded := *w.walkByExpansion(walkCtx, data, expansionFilter, recursive, nil)
+	if err := w.failed(); err != nil {
+		return nil, w.budget.usage(), err
 	}
 
+	filtered := walkByFilter(expanded, fieldFilter)
+
+	return filtered, w.budget.usage(), w.errWithContext(ctx)
+}
+
+func (e *Expander) ExpandArray(data interface{}, expansion, fields string) []interface{} {
 	expansionFilter, fieldFilter, recursiveExpansion, err := resolveFilters(expansion, fields)
 	if err != nil {
 		expansionFilter = Filters{}
@@ -171,10 +572,38 @@ func ExpandArray(data interface{}, expansion, fields string) []interface{} {
 		fmt.Printf("Warning: Filter was not correct, expansionFilter: '%v' fieldFilter: '%v', error: %v \n", expansionFilter, fieldFilter, err)
 	}
 
+	result, _, err := e.expandArray(context.Background(), data, expansionFilter, fieldFilter, recursiveExpansion)
+	if err != nil {
+		printWarnings(err)
+	}
+
+	return result
+}
+
+func (e *Expander) ExpandArrayE(data interface{}, expansion, fields string) ([]interface{}, error) {
+	return e.ExpandArrayContext(context.Background(), data, expansion, fields)
+}
+
+func (e *Expander) ExpandArrayContext(ctx context.Context, data interface{}, expansion, fields string) ([]interface{}, error) {
+	result, _, err := e.ExpandArrayWithUsage(ctx, data, expansion, fields)
+	return result, err
+}
+
+func (e *Expander) ExpandArrayWithUsage(ctx context.Context, data interface{}, expansion, fields string) ([]interface{}, BudgetUsage, error) {
+	expansionFilter, fieldFilter, recursiveExpansion, err := resolveFilters(expansion, fields)
+	if err != nil {
+		return nil, BudgetUsage{}, err
+	}
+
+	return e.expandArray(ctx, data, expansionFilter, fieldFilter, recursiveExpansion)
+}
+
+func (e *Expander) expandArray(ctx context.Context, data interface{}, expansionFilter, fieldFilter Filters, recursive bool) ([]interface{}, BudgetUsage, error) {
 	var result []interface{}
+	w := e.newWalker()
 
 	if data == nil {
-		return result
+		return result, w.budget.usage(), w.err()
 	}
 
 	v := reflect.ValueOf(data)
@@ -184,74 +613,189 @@ func ExpandArray(data interface{}, expansion, fields string) []interface{} {
 	}
 
 	if v.Kind() != reflect.Slice {
-		return result
+		return result, w.budget.usage(), w.err()
 	}
 
 	v = v.Slice(0, v.Len())
+	result = make([]interface{}, v.Len())
+	walkCtx, cancel := w.budget.withDeadline(e.withOutboundHeaders(ctx))
+	defer cancel()
+	w.cancel = cancel
+	var wg sync.WaitGroup
+
 	for i := 0; i < v.Len(); i++ {
-		arrayItem := *walkByExpansion(v.Index(i), expansionFilter, recursiveExpansion)
-		arrayItem = walkByFilter(arrayItem, fieldFilter)
-		result = append(result, arrayItem)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			arrayItem := *w.walkByExpansion(walkCtx, v.Index(i), expansionFilter, recursive, nil)
+			result[i] = walkByFilter(arrayItem, fieldFilter)
+		}(i)
 	}
-	return result
+
+	wg.Wait()
+	if err := w.failed(); err != nil {
+		return nil, w.budget.usage(), err
+	}
+
+	return result, w.budget.usage(), w.errWithContext(ctx)
 }
 
-func walkByFilter(data map[string]interface{}, filters Filters) map[string]interface{} {
-	result := make(map[string]interface{})
+type fetchSlotsKey struct{}
+
+// walker holds the state of a single Expand call.
+type walker struct {
+	*Expander
+	errors      ExpansionErrors
+	errorsMutex sync.Mutex
+	fetchSlots  chan struct{}
+	budget      *budget
+	cancel      context.CancelFunc
+	failure     error
+}
+
+func (e *Expander) newWalker() *walker {
+	maxConcurrentFetches := e.config.MaxConcurrentFetches
+	if maxConcurrentFetches <= 0 {
+		maxConcurrentFetches = DEFAULT_MAX_CONCURRENT_FETCHES
+	}
+
+	return &walker{
+		Expander:   e,
+		fetchSlots: make(chan struct{}, maxConcurrentFetches),
+		budget:     e.newBudget(),
+		cancel:     func() {},
+	}
+}
+
+// fail stops the whole expansion with the first err it is given.
+func (w *walker) fail(err error) {
+	w.errorsMutex.Lock()
+	if w.failure == nil {
+		w.failure = err
+	}
+	w.errorsMutex.Unlock()
+
+	w.cancel()
+}
+
+func (w *walker) failed() error {
+	w.errorsMutex.Lock()
+	defer w.errorsMutex.Unlock()
+
+	return w.failure
+}
+
+func (w *walker) addError(err error) {
+	w.errorsMutex.Lock()
+	w.errors = append(w.errors, err)
+	w.errorsMutex.Unlock()
+}
+
+func (w *walker) err() error {
+	w.errorsMutex.Lock()
+	defer w.errorsMutex.Unlock()
+
+	if len(w.errors) == 0 {
+		return nil
+	}
+
+	return w.errors
+}
+
+// errWithContext reports a cancelled or expired ctx only once, instead of once
+// per reference that was skipped because of it.
+func (w *walker) errWithContext(ctx context.Context) error {
+	if ctx.Err() != nil {
+		w.addError(ctx.Err())
+	}
 
+	return w.err()
+}
+
+func walkByFilter(data map[string]interface{}, filters Filters) map[string]interface{} {
 	if data == nil {
-		return result
+		// a link replaced with null stays null
+		return nil
 	}
 
+	result := make(map[string]interface{})
+
 	for k, v := range data {
-		if filters.IsEmpty() || filters.Contains(k) {
-			ft := reflect.ValueOf(v)
+		if filters.Keeps(k) {
+			result[k] = filterValue(v, filters.Get(k).Children)
+		} else if filters.descends() {
+			// a ** filter might match something below k, k is kept if it does
+			if value, ok := filterDescendants(v, filters.Get(k).Children); ok {
+				result[k] = value
+			}
+		}
+	}
 
-			result[k] = v
-			subFilters := filters.Get(k).Children
+	return result
+}
 
-			if v == nil {
-				continue
-			}
+func filterValue(v interface{}, filters Filters) interface{} {
+	if v == nil {
+		return v
+	}
 
-			switch ft.Type().Kind() {
-			case reflect.Map:
-				result[k] = walkByFilter(v.(map[string]interface{}), subFilters)
-			case reflect.Slice:
-				if ft.Len() == 0 {
-					continue
-				}
+	ft := reflect.ValueOf(v)
+	switch ft.Type().Kind() {
+	case reflect.Map:
+		return walkByFilter(v.(map[string]interface{}), filters)
+	case reflect.Slice:
+		if ft.Len() == 0 {
+			return v
+		}
 
-				switch ft.Index(0).Kind() {
-				case reflect.Map:
-					children := make([]map[string]interface{}, 0)
-				for _, child := range v.([]map[string]interface{}) {
-					item := walkByFilter(child, subFilters)
+		switch ft.Index(0).Kind() {
+		case reflect.Map:
+			children := make([]map[string]interface{}, 0)
+			for _, child := range v.([]map[string]interface{}) {
+				item := walkByFilter(child, filters)
+				children = append(children, item)
+			}
+			return children
+		default:
+			children := make([]interface{}, 0)
+			for _, child := range v.([]interface{}) {
+				if child != nil && reflect.TypeOf(child).Kind() == reflect.Map {
+					item := walkByFilter(child.(map[string]interface{}), filters)
 					children = append(children, item)
-				}
-					result[k] = children
-				default:
-					children := make([]interface{}, 0)
-				for _, child := range v.([]interface{}) {
-					cft := reflect.TypeOf(child)
-
-					if cft.Kind() == reflect.Map {
-						item := walkByFilter(child.(map[string]interface{}), subFilters)
-						children = append(children, item)
-					} else {
-						children = append(children, child)
-					}
-				}
-					result[k] = children
+				} else {
+					children = append(children, child)
 				}
 			}
+			return children
 		}
 	}
 
-	return result
+	return v
 }
 
-func walkByExpansion(data interface{}, filters Filters, recursive bool) *map[string]interface{} {
+// filterDescendants filters v, if anything is left of it.
+func filterDescendants(v interface{}, filters Filters) (interface{}, bool) {
+	switch value := filterValue(v, filters).(type) {
+	case map[string]interface{}:
+		return value, len(value) > 0
+	case []map[string]interface{}:
+		for _, item := range value {
+			if len(item) > 0 {
+				return value, true
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if m, ok := item.(map[string]interface{}); ok && len(m) > 0 {
+				return value, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+func (w *walker) walkByExpansion(ctx context.Context, data interface{}, filters Filters, recursive bool, visited []string) *map[string]interface{} {
 	result := make(map[string]interface{})
 
 	if data == nil {
@@ -267,19 +811,22 @@ func walkByExpansion(data interface{}, filters Filters, recursive bool) *map[str
 		v = v.Elem()
 	}
 
-	//	var resultWriteMutex = sync.Mutex{}
+	var resultWriteMutex = sync.Mutex{}
 	var writeToResult = func(key string, value interface{}) {
-		//resultWriteMutex.Lock()
+		resultWriteMutex.Lock()
 		result[key] = value
-		//resultWriteMutex.Unlock()
+		resultWriteMutex.Unlock()
 	}
 
+	// references are resolved in parallel, every one of them writes to its own key
+	var wg sync.WaitGroup
+
 	// check if root is db ref
-	if isMongoDBRef(v) && recursive {
-		uri := buildReferenceURI(v)
+	if w.isMongoDBRef(v) && recursive {
+		ref := Reference{Ref: w.buildReferenceURI(v)}
 		key := v.Type().Field(1).Name
 		placeholder := make(map[string]interface{})
-		resource, _ := getResourceFrom(uri, filters.Get(key).Children, recursive)
+		resource, _ := w.getResourceFrom(ctx, ref, filters.Get(key).Children, recursive, visited)
 		for k, v := range resource {
 			placeholder[k] = v
 		}
@@ -304,20 +851,30 @@ func walkByExpansion(data interface{}, filters Filters, recursive bool) *map[str
 			return recursive, key
 		}
 
-		if isMongoDBRef(f) {
-			if filters.Contains(key) || recursive {
-				uri := buildReferenceURI(f)
-				resource, ok := getResourceFrom(uri, filters.Get(key).Children, recursive)
-				if ok && len(resource) > 0 {
-					writeToResult(key, resource)
-				}else {
-					writeToResult(key, f.Interface())
-				}
+		if w.isMongoDBRef(f) {
+			if filters.expands(key, recursive) {
+				ref := Reference{Ref: w.buildReferenceURI(f)}
+				wg.Add(1)
+				go func(key string, f reflect.Value) {
+					defer wg.Done()
+					resource, ok := w.getResourceFrom(ctx, ref, filters.Get(key).Children, recursive, visited)
+					if ok && (resource == nil || len(resource) > 0) {
+						writeToResult(key, resource)
+					} else {
+						writeToResult(key, f.Interface())
+					}
+				}(key, f)
 			} else {
 				writeToResult(key, f.Interface())
 			}
 		} else {
-			val := getValue(f, filters, options)
+			fieldFilters := filters
+			if recursive && f.Kind() == reflect.Struct {
+				// the filters of a recursive expansion are field filters,
+				// they go into a struct like into the map it becomes
+				fieldFilters = filters.Get(key).Children
+			}
+			val := w.getValue(ctx, f, fieldFilters, options, visited)
 			writeToResult(key, val)
 			switch val.(type) {
 			case string:
@@ -328,22 +885,27 @@ func walkByExpansion(data interface{}, filters Filters, recursive bool) *map[str
 			}
 
 			if isReference(f) {
-				if filters.Contains(key) || recursive {
-					uri := getReferenceURI(f)
-					resource, ok := getResourceFrom(uri, filters.Get(key).Children, recursive)
-					if ok {
-						writeToResult(key, resource)
-					}
+				if filters.expands(key, recursive) {
+					ref := getReference(f)
+					wg.Add(1)
+					go func(key string) {
+						defer wg.Done()
+						resource, ok := w.getResourceFrom(ctx, ref, filters.Get(key).Children, recursive, visited)
+						if ok {
+							writeToResult(key, resource)
+						}
+					}(key)
 				}
 			}
 		}
 
 	}
 
+	wg.Wait()
 	return &result
 }
 
-func getValue(t reflect.Value, filters Filters, options func() (bool, string)) interface{} {
+func (w *walker) getValue(ctx context.Context, t reflect.Value, filters Filters, options func() (bool, string), visited []string) interface{} {
 	recursive, parentKey := options()
 
 	switch t.Kind() {
@@ -358,46 +920,53 @@ func getValue(t reflect.Value, filters Filters, options func() (bool, string)) i
 	case reflect.String:
 		return t.String()
 	case reflect.Slice:
-		var result = []interface{}{}
+		var result = make([]interface{}, t.Len())
+
+		// every item is resolved in parallel and written to its own index
+		var wg sync.WaitGroup
+		var resolve = func(i int, ref Reference) {
+			defer wg.Done()
+			resource, ok := w.getResourceFrom(ctx, ref, filters.Get(parentKey).Children, recursive, visited)
+			if ok {
+				result[i] = resource
+			}
+		}
 
 		for i := 0; i < t.Len(); i++ {
 			current := t.Index(i)
 
-			if filters.Contains(parentKey) || recursive {
+			if filters.expands(parentKey, recursive) {
 				if isReference(current) {
-					uri := getReferenceURI(current)
+					ref := getReference(current)
 
 					//TODO: this fails in case the resource cannot be resolved, because current is DBRef not map[string]interface{}
-					result = append(result, current.Interface())
-					resource, ok := getResourceFrom(uri, filters.Get(parentKey).Children, recursive)
-					if ok {
-						result[i] = resource
-					}
-				} else if isMongoDBRef(current) {
-					uri := buildReferenceURI(current)
+					result[i] = current.Interface()
+					wg.Add(1)
+					go resolve(i, ref)
+				} else if w.isMongoDBRef(current) {
+					ref := Reference{Ref: w.buildReferenceURI(current)}
 
 					//TODO: this fails in case the resource cannot be resolved, because current is DBRef not map[string]interface{}
-					result = append(result, current.Interface())
-					resource, ok := getResourceFrom(uri, filters.Get(parentKey).Children, recursive)
-					if ok {
-						result[i] = resource
-					}
+					result[i] = current.Interface()
+					wg.Add(1)
+					go resolve(i, ref)
 				} else {
-					result = append(result, getValue(current, filters.Get(parentKey).Children, options))
+					result[i] = w.getValue(ctx, current, filters.Get(parentKey).Children, options, visited)
 				}
 			} else {
-				result = append(result, getValue(current, filters.Get(parentKey).Children, options))
+				result[i] = w.getValue(ctx, current, filters.Get(parentKey).Children, options, visited)
 			}
 		}
 
+		wg.Wait()
 		return result
 	case reflect.Map:
 		result := make(map[string]interface{})
 
-	for _, v := range t.MapKeys() {
-		key := v.Interface().(string)
-		result[key] = getValue(t.MapIndex(v), filters.Get(key).Children, options)
-	}
+		for _, v := range t.MapKeys() {
+			key := v.Interface().(string)
+			result[key] = w.getValue(ctx, t.MapIndex(v), filters.Get(key).Children, options, visited)
+		}
 
 		return result
 	case reflect.Struct:
@@ -405,66 +974,190 @@ func getValue(t reflect.Value, filters Filters, options func() (bool, string)) i
 		if ok {
 			bytes, err := val.(json.Marshaler).MarshalJSON()
 			if err != nil {
-				fmt.Println(err)
+				w.addError(&DecodeError{Err: err})
 			}
 
 			return string(bytes)
 		}
 
-		return *walkByExpansion(t, filters, recursive)
+		return *w.walkByExpansion(ctx, t, filters, recursive, visited)
 	default:
 		return t.Interface()
 	}
-
-	return ""
 }
 
-func getResourceFrom(u string, filters Filters, recursive bool) (map[string]interface{}, bool) {
-	ok := false
-	uri, err := url.ParseRequestURI(u)
+func (w *walker) getResourceFrom(ctx context.Context, ref Reference, filters Filters, recursive bool, visited []string) (map[string]interface{}, bool) {
 	var m map[string]interface{}
 
-	if err == nil {
-		content := getContentFrom(uri)
-		err := json.Unmarshal([]byte(content), &m)
-		if err != nil {
-			return m, false
+	_, err := url.ParseRequestURI(ref.Ref)
+	if err != nil {
+		return m, false
+	}
+	if ctx.Err() != nil {
+		return w.stoppedByContext(ref)
+	}
+
+	for _, uri := range visited {
+		if uri == ref.Ref {
+			return stoppedLink(ref, STOPPED_BY_CYCLE), true
 		}
-		ok = true
-		if hasReference(m) {
-			return *expandChildren(m, filters, recursive), ok
+	}
+	if len(visited) >= w.maxExpansionDepth() {
+		return stoppedLink(ref, STOPPED_BY_MAX_DEPTH), true
+	}
+	// every branch gets its own copy, siblings are resolved in parallel
+	visited = append(visited[:len(visited):len(visited)], ref.Ref)
+
+	if verb := verbOf(ref); !w.verbAllowed(verb) {
+		return w.resolveFailure(ref, &FetchError{URI: ref.Ref, Err: fmt.Errorf("%w: %v", ErrVerbNotAllowed, verb)})
+	}
+
+	// only the cache and the fetch of ref see the headers meant for its host
+	fetchCtx := w.outboundHeadersFor(ctx, ref)
+	cached, content, ok := w.getFromCache(fetchCtx, ref)
+	if !ok {
+		err = cached.failedRecently(ref, time.Now())
+		if err == nil {
+			reason, ok := w.budget.reserve()
+			if !ok {
+				return stoppedLink(ref, reason), true
+			}
+
+			content, err = w.fetch(context.WithValue(fetchCtx, fetchSlotsKey{}, w.fetchSlots), ref)
+
+			if err != nil && ctx.Err() != nil {
+				return w.stoppedByContext(ref)
+			}
+			w.budget.addBytes(len(content))
 		}
+
+		if err != nil {
+			content, ok = w.staleIfError(cached)
+			if !ok {
+				return w.resolveFailure(ref, err)
+			}
+		}
+	}
+
+	if len(content) == 0 {
+		// e.g. HEAD or 204 No Content, nothing to expand the link with
+		return m, false
+	}
+
+	err = json.Unmarshal(content, &m)
+	if err != nil {
+		return w.resolveFailure(ref, &DecodeError{URI: ref.Ref, Err: err})
+	}
+	if m == nil {
+		return m, false
+	}
+
+	if hasReference(m) {
+		return *w.expandChildren(ctx, m, filters, recursive, visited), true
+	}
+
+	return m, true
+}
+
+func (e *Expander) maxExpansionDepth() int {
+	if e.config.MaxExpansionDepth <= 0 {
+		return DEFAULT_MAX_EXPANSION_DEPTH
+	}
+
+	return e.config.MaxExpansionDepth
+}
+
+// resolveFailure replaces ref according to the ErrorPolicy of the status class
+// of err. A nil resource with ok=true means the link is replaced with null.
+func (w *walker) resolveFailure(ref Reference, err error) (map[string]interface{}, bool) {
+	w.addError(err)
+
+	status := statusOf(err)
+	switch w.config.ErrorPolicies[status/100] {
+	case REPLACE_WITH_NULL:
+		return nil, true
+	case EMBED_ERROR:
+		return errorLink(ref, status, err), true
+	case FAIL_EXPANSION:
+		w.fail(err)
+	}
+
+	return nil, false
+}
+
+func errorLink(ref Reference, status int, err error) map[string]interface{} {
+	return map[string]interface{}{
+		REF_KEY:     ref.Ref,
+		STATUS_KEY:  status,
+		MESSAGE_KEY: messageOf(err),
+	}
+}
+
+// stoppedByContext leaves the link as it is when ctx was done. If it is the
+// deadline of the expansion that passed, the link is marked as stopped.
+func (w *walker) stoppedByContext(ref Reference) (map[string]interface{}, bool) {
+	if w.budget.deadlinePassed() {
+		w.budget.skip()
+		return stoppedLink(ref, STOPPED_BY_DEADLINE), true
 	}
 
-	return m, ok
+	return nil, false
 }
 
-func expandChildren(m map[string]interface{}, filters Filters, recursive bool) *map[string]interface{} {
+// stoppedLink leaves the reference as a link, and tells why it wasn't expanded.
+func stoppedLink(ref Reference, reason string) map[string]interface{} {
+	link := map[string]interface{}{
+		REF_KEY:     ref.Ref,
+		STOPPED_KEY: reason,
+	}
+	if ref.Rel != "" {
+		link[REL_KEY] = ref.Rel
+	}
+	if ref.Verb != "" {
+		link[VERB_KEY] = ref.Verb
+	}
+
+	return link
+}
+
+func (w *walker) expandChildren(ctx context.Context, m map[string]interface{}, filters Filters, recursive bool, visited []string) *map[string]interface{} {
 	result := make(map[string]interface{})
+	var resultWriteMutex = sync.Mutex{}
+	var wg sync.WaitGroup
 
 	for key, v := range m {
-		ft := reflect.TypeOf(v)
 		result[key] = v
+	}
+
+	for key, v := range m {
+		ft := reflect.TypeOf(v)
 		if v == nil {
 			continue
 		}
-		if ft.Kind() == reflect.Map && (recursive || filters.Contains(key)) {
+		if ft.Kind() == reflect.Map && filters.expands(key, recursive) {
 			child := v.(map[string]interface{})
-			uri, found := child[REF_KEY]
+			_, found := child[REF_KEY]
 
 			if found {
-				resource, ok := getResourceFrom(uri.(string), filters, recursive)
-				if ok {
-					result[key] = resource
-				}
+				wg.Add(1)
+				go func(key string, ref Reference) {
+					defer wg.Done()
+					resource, ok := w.getResourceFrom(ctx, ref, filters.Get(key).Children, recursive, visited)
+					if ok {
+						resultWriteMutex.Lock()
+						result[key] = resource
+						resultWriteMutex.Unlock()
+					}
+				}(key, getReferenceFromMap(child))
 			}
 		}
 	}
 
+	wg.Wait()
 	return &result
 }
 
-func buildReferenceURI(t reflect.Value) string {
+func (e *Expander) buildReferenceURI(t reflect.Value) string {
 	var uri string
 
 	if t.Kind() == reflect.Struct {
@@ -478,8 +1171,8 @@ func buildReferenceURI(t reflect.Value) string {
 			} else {
 				objectId, ok := f.Interface().(ObjectId)
 				if ok {
-					base := ExpanderConfig.IdURIs[collection]
-					uri = base+"/"+objectId.Hex()
+					base := e.config.IdURIs[collection]
+					uri = base + "/" + objectId.Hex()
 				}
 			}
 		}
@@ -488,8 +1181,8 @@ func buildReferenceURI(t reflect.Value) string {
 	return uri
 }
 
-func isMongoDBRef(t reflect.Value) bool {
-	mongoEnabled := ExpanderConfig.UsingMongo && len(ExpanderConfig.IdURIs) > 0
+func (e *Expander) isMongoDBRef(t reflect.Value) bool {
+	mongoEnabled := e.config.UsingMongo && len(e.config.IdURIs) > 0
 
 	if !mongoEnabled {
 		return false
@@ -515,9 +1208,13 @@ func isMongoDBRef(t reflect.Value) bool {
 	return false
 }
 
-func isRefKey(ft reflect.StructField) bool {
+func isKey(ft reflect.StructField, key string) bool {
 	tag := strings.Split(ft.Tag.Get("json"), ",")[0]
-	return ft.Name == REF_KEY || tag == REF_KEY
+	return ft.Name == key || tag == key
+}
+
+func isRefKey(ft reflect.StructField) bool {
+	return isKey(ft, REF_KEY)
 }
 
 func isReference(t reflect.Value) bool {
@@ -553,6 +1250,37 @@ func hasReference(m map[string]interface{}) bool {
 	return false
 }
 
+func getReference(t reflect.Value) Reference {
+	var ref Reference
+
+	if t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			ft := t.Type().Field(i)
+
+			switch {
+			case isKey(ft, REF_KEY):
+				ref.Ref = t.Field(i).String()
+			case isKey(ft, REL_KEY):
+				ref.Rel = t.Field(i).String()
+			case isKey(ft, VERB_KEY):
+				ref.Verb = t.Field(i).String()
+			}
+		}
+	}
+
+	return ref
+}
+
+func getReferenceFromMap(m map[string]interface{}) Reference {
+	var ref Reference
+
+	ref.Ref, _ = m[REF_KEY].(string)
+	ref.Rel, _ = m[REL_KEY].(string)
+	ref.Verb, _ = m[VERB_KEY].(string)
+
+	return ref
+}
+
 func getReferenceURI(t reflect.Value) string {
 	if t.Kind() == reflect.Struct {
 		for i := 0; i < t.NumField(); i++ {
@@ -567,150 +1295,326 @@ func getReferenceURI(t reflect.Value) string {
 	return ""
 }
 
-var makeGetCall = func(uri *url.URL) string {
-	if !httpClientIsInitialized {
-		initializerMutex.Lock()
-		if !initializingHttpClient {
-			initializingHttpClient = true
-			Init()
+// fetchOnce collapses concurrent fetches of the same reference into a single
+// call, within one expansion as well as across expansions of the same instance.
+// Fetches with different ForwardHeaders are not collapsed, the ones going
+// through a request hook are not collapsed at all.
+func (e *Expander) fetchOnce(ctx context.Context, ref Reference, fetch func(context.Context, Reference) ([]byte, error)) ([]byte, error) {
+	key := cacheKey(ctx, ref)
+	if verb := verbOf(ref); verb != "GET" {
+		key = verb + " " + key
+	}
+
+	value, err := e.flights.Do(key, func() (interface{}, error) {
+		return fetch(ctx, ref)
+	})
+
+	if err != nil && ctx.Err() == nil && isContextError(err) {
+		// the call we joined was cancelled by its own caller, not by us
+		return fetch(ctx, ref)
+	}
+
+	content, _ := value.([]byte)
+	return content, err
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (e *Expander) fetchAndAddToCache(ctx context.Context, ref Reference) ([]byte, error) {
+	key := cacheKey(ctx, ref)
+	cached, _ := e.getCachedResource(key)
+
+	content, err := e.fetchIntoCache(ctx, ref, key, cached)
+	if err != nil && ctx.Err() == nil && !errors.Is(err, ErrCircuitOpen) {
+		e.addFailureToCache(key, cached, err)
+	}
+
+	return content, err
+}
+
+func (e *Expander) fetchIntoCache(ctx context.Context, ref Reference, key string, cached *cachedResource) ([]byte, error) {
+	response, err := e.fetchConditional(ctx, ref, cached.validators())
+	if err != nil {
+		return nil, err
+	}
+
+	if response.NotModified {
+		if cached == nil {
+			return nil, &FetchError{URI: ref.Ref, StatusCode: http.StatusNotModified, Err: errors.New("nothing cached to revalidate")}
 		}
-		initializerMutex.Unlock()
+		e.addToCache(key, cached, response.Header)
+		return cached.Content, nil
+	}
+
+	valueToReturn := response.Content
+	var responseMap map[string]interface{}
+	err = json.Unmarshal(valueToReturn, &responseMap)
+	if err != nil {
+		return nil, &DecodeError{URI: ref.Ref, Err: err}
+	}
+
+	message, ok := responseMap["error"]
+	if ok {
+		return nil, &FetchError{URI: ref.Ref, Err: fmt.Errorf("response contains an error: %v", message)}
 	}
 
-	response, err := client.Get(uri.String())
+	e.addToCache(key, &cachedResource{Content: valueToReturn}, response.Header)
+	return valueToReturn, nil
+}
+
+func (e *Expander) fetchConditional(ctx context.Context, ref Reference, validators Validators) (*Response, error) {
+	return e.fetchResilient(ctx, ref, func() (*Response, error) {
+		return e.fetchLimited(ctx, ref, validators)
+	})
+}
+
+// fetchLimited sends a single fetch once the HostLimits of ref allow.
+func (e *Expander) fetchLimited(ctx context.Context, ref Reference, validators Validators) (*Response, error) {
+	release, err := e.limiters.acquire(ctx, ref, e.config.HostLimits)
 	if err != nil {
-		fmt.Println(err)
-		return ""
+		return nil, &FetchError{URI: ref.Ref, Err: err}
+	}
+	defer release()
+
+	// the slot of the expansion is taken after the host let us through, so
+	// the fetches waiting for a limited host don't hold up the other hosts
+	if slots, ok := ctx.Value(fetchSlotsKey{}).(chan struct{}); ok {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			return nil, &FetchError{URI: ref.Ref, Err: ctx.Err()}
+		}
 	}
 
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
+	if fetcher, ok := e.fetcher.(ConditionalFetcher); ok {
+		return fetcher.FetchConditional(ctx, ref, validators)
+	}
 
+	content, err := e.fetcher.Fetch(ctx, ref)
 	if err != nil {
-		fmt.Println("Error while reading content of response body. It was: ", err)
+		return nil, err
 	}
 
-	return string(contents)
+	return &Response{Content: content}, nil
 }
 
-var makeGetCallAndAddToCache = func(uri *url.URL) string {
-	valueToReturn := makeGetCall(uri)
+func (e *Expander) fetchUncached(ctx context.Context, ref Reference) ([]byte, error) {
+	response, err := e.fetchConditional(ctx, ref, Validators{})
+	if err != nil {
+		return nil, err
+	}
 
-	var responseMap map[string]interface{}
-	err := json.Unmarshal([]byte(valueToReturn), &responseMap)
+	return response.Content, nil
+}
+
+// addToCache stores resource as long as the caching headers of its response
+// allow. Resources with an ETag or Last-Modified are kept after they expired,
+// so they can be revalidated with a conditional request.
+func (e *Expander) addToCache(key string, resource *cachedResource, header http.Header) {
+	now := time.Now()
+	policy := cachePolicyOf(header, seconds(e.config.CacheExpInSeconds), now)
+	if policy.noStore {
+		e.cache.Delete(key)
+		return
+	}
 
-	_, ok := responseMap["error"]
-	if err != nil || ok {
-		return ""
+	if etag := header.Get("ETag"); etag != "" {
+		resource.ETag = etag
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		resource.LastModified = lastModified
 	}
+	resource.FreshUntil = now.Add(policy.freshFor)
+	resource.Failure = nil
 
-	cacheEntry := CacheEntry{
-		Timestamp: time.Now().Unix(),
-		Data:      valueToReturn,
+	ttl := policy.freshFor + e.keepStaleFor(resource)
+	if ttl <= 0 {
+		return
+	}
+
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return
 	}
-	CacheMutex.Lock()
-	Cache.Add(uri.String(), cacheEntry)
-	CacheMutex.Unlock()
-	return valueToReturn
+	e.cache.Set(key, data, ttl)
 }
 
+// addFailureToCache remembers err for CacheFailuresForInSeconds, so a broken
+// reference is not fetched again on every expansion. The content cached
+// before is kept to be served stale.
+func (e *Expander) addFailureToCache(key string, cached *cachedResource, err error) {
+	window := seconds(e.config.CacheFailuresForInSeconds)
+	if window <= 0 {
+		return
+	}
 
-var getContentFrom = func(uri *url.URL) string {
-	if ExpanderConfig.UsingCache {
-		CacheMutex.Lock()
-		value, ok := Cache.Get(uri.String())
-		CacheMutex.Unlock()
-		if !ok {
-			//no data found in cache
-			return makeGetCallAndAddToCache(uri)
-		}
+	now := time.Now()
+	resource := cached
+	if resource == nil {
+		resource = &cachedResource{}
+	}
+	resource.Failure = &cachedFailure{
+		StatusCode: statusOf(err),
+		Message:    messageOf(err),
+		Until:      now.Add(window),
+	}
+
+	ttl := resource.FreshUntil.Add(e.keepStaleFor(resource)).Sub(now)
+	if ttl < window {
+		ttl = window
+	}
 
-		cachedData := value.(CacheEntry)
-		nowInMillis := time.Now().Unix()
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return
+	}
+	e.cache.Set(key, data, ttl)
+}
 
-		if nowInMillis-cachedData.Timestamp > ExpanderConfig.CacheExpInSeconds {
-			//data older then Expiration
-			CacheMutex.Lock()
-			Cache.Remove(uri.String())
-			CacheMutex.Unlock()
-			return makeGetCallAndAddToCache(uri)
+// keepStaleFor is how long resource is kept after it expired, to be
+// revalidated or served stale.
+func (e *Expander) keepStaleFor(resource *cachedResource) time.Duration {
+	var keep time.Duration
+	if resource.revalidatable() {
+		keep = seconds(e.config.CacheKeepStaleInSeconds)
+		if keep <= 0 {
+			keep = seconds(e.config.CacheExpInSeconds)
 		}
+	}
+	if window := seconds(e.config.CacheStaleWhileRevalidateInSeconds); window > keep {
+		keep = window
+	}
+	if window := seconds(e.config.CacheStaleIfErrorInSeconds); window > keep {
+		keep = window
+	}
+
+	return keep
+}
+
+func seconds(s int64) time.Duration {
+	return time.Duration(s) * time.Second
+}
+
+// getCachedResource returns the cached resource of ref, fresh or not.
+func (e *Expander) getCachedResource(key string) (*cachedResource, bool) {
+	data, ok := e.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
 
-		return cachedData.Data
+	var resource cachedResource
+	if err := json.Unmarshal(data, &resource); err != nil {
+		return nil, false
 	}
 
-	return makeGetCall(uri)
+	return &resource, true
 }
 
-func validateFilterFormat(filter string) bool {
-	runes := []rune(filter)
+// caches tells if the responses for ref are cached. Only GET responses are,
+// HEAD ones have no content to cache and the other verbs are not cacheable.
+func (e *Expander) caches(ref Reference) bool {
+	return e.config.UsingCache && verbOf(ref) == "GET" && !e.hooked()
+}
 
-	var bracketCounter = 0
+// hooked tells if the requests go through a hook, which might make them
+// different for each caller without showing up in the cache key.
+func (e *Expander) hooked() bool {
+	fetcher, ok := e.fetcher.(*HTTPFetcher)
+	return ok && fetcher.PrepareRequest != nil
+}
 
-	for i := range runes {
-		if runes[i] == '(' {
-			bracketCounter++
-		}else if runes[i] == ')' {
-			bracketCounter--
-			if bracketCounter < 0 {
-				return false
-			}
+// verbAllowed tells if verb may be sent. Verbs other than GET, HEAD and
+// OPTIONS could change something, so they have to be in AllowedVerbs.
+func (e *Expander) verbAllowed(verb string) bool {
+	switch verb {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+
+	for _, allowed := range e.config.AllowedVerbs {
+		if strings.EqualFold(allowed, verb) {
+			return true
 		}
 	}
-	return bracketCounter == 0
 
+	return false
 }
 
-func buildFilterTree(statement string) ([]Filter, int) {
-	var result []Filter
-	const comma uint8 = ','
-	const openBracket uint8 = '('
-	const closeBracket uint8 = ')'
+// getFromCache returns the content of ref if it is fresh, or if it expired
+// less than CacheStaleWhileRevalidateInSeconds ago, in which case it is
+// refreshed in the background. The cached resource is returned in any case.
+func (e *Expander) getFromCache(ctx context.Context, ref Reference) (*cachedResource, []byte, bool) {
+	if !e.caches(ref) {
+		return nil, nil, false
+	}
 
-	if statement == "*" {
-		return result, -1
+	resource, ok := e.getCachedResource(cacheKey(ctx, ref))
+	if !ok {
+		atomic.AddInt64(&e.stats.misses, 1)
+		return nil, nil, false
 	}
 
-	statement = strings.Replace(statement, " ", "", -1)
-	if len(statement) == 0 {
-		return result, -1
+	now := time.Now()
+	if resource.fresh(now) {
+		atomic.AddInt64(&e.stats.hits, 1)
+		return resource, resource.Content, true
 	}
+	if resource.staleWithin(now, seconds(e.config.CacheStaleWhileRevalidateInSeconds)) {
+		atomic.AddInt64(&e.stats.staleServes, 1)
+		// a refresh that failed is not tried again for CacheFailuresForInSeconds
+		if resource.failedRecently(ref, now) == nil {
+			go e.refresh(ctx, ref)
+		}
+		return resource, resource.Content, true
+	}
+
+	atomic.AddInt64(&e.stats.misses, 1)
+	return resource, nil, false
+}
 
-	indexAfterSeparation := 0
-	closeIndex := 0
+// staleIfError returns the content of resource if refreshing it failed less
+// than CacheStaleIfErrorInSeconds after it expired.
+func (e *Expander) staleIfError(resource *cachedResource) ([]byte, bool) {
+	if resource == nil || !resource.staleWithin(time.Now(), seconds(e.config.CacheStaleIfErrorInSeconds)) {
+		return nil, false
+	}
 
-	for i := 0; i < len(statement); i++ {
-		switch statement[i] {
-		case openBracket:
-			filter := Filter{Value: string(statement[indexAfterSeparation:i])}
-			filter.Children, closeIndex = buildFilterTree(statement[i+1:])
-			result = append(result, filter)
-			i = i+closeIndex
-			indexAfterSeparation = i+1
-			closeIndex = indexAfterSeparation
-		case comma:
-			filter := Filter{Value: string(statement[indexAfterSeparation:i])}
-			if filter.Value != "" {
-				result = append(result, filter)
-			}
-			indexAfterSeparation = i+1
-		case closeBracket:
-			filter := Filter{Value: string(statement[indexAfterSeparation:i])}
-			if filter.Value != "" {
-				result = append(result, filter)
-			}
+	atomic.AddInt64(&e.stats.staleServes, 1)
+	return resource.Content, true
+}
 
-			return result, i+1
-		}
+// refresh fetches ref into the cache, independent of the expansion that
+// served it stale, but with the same headers. Only one refresh of a key runs
+// at a time, the expansions serving it stale meanwhile don't start another.
+func (e *Expander) refresh(ctx context.Context, ref Reference) {
+	key := cacheKey(ctx, ref)
+	if _, running := e.refreshes.LoadOrStore(key, true); running {
+		return
 	}
+	defer e.refreshes.Delete(key)
 
-	if indexAfterSeparation > closeIndex {
-		result = append(result, Filter{Value: string(statement[indexAfterSeparation:])})
+	// the refresh before might have failed since the entry was read
+	if cached, ok := e.getCachedResource(key); ok && cached.failedRecently(ref, time.Now()) != nil {
+		return
 	}
 
-	if indexAfterSeparation == 0 {
-		result = append(result, Filter{Value: statement})
+	e.fetch(context.WithoutCancel(ctx), ref)
+}
+
+func (e *Expander) fetch(ctx context.Context, ref Reference) ([]byte, error) {
+	if e.caches(ref) {
+		return e.fetchOnce(ctx, ref, e.fetchAndAddToCache)
 	}
+	if e.hooked() {
+		return e.fetchUncached(ctx, ref)
+	}
+
+	return e.fetchOnce(ctx, ref, e.fetchUncached)
+}
 
-	return result, -1
+func buildFilterTree(statement string) (Filters, error) {
+	return ParseFilters(statement)
 }
@@ -1,12 +1,20 @@
 package expander
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
 	"reflect"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -38,7 +46,7 @@ func TestExpander(t *testing.T) {
 					So(result["UI"], ShouldEqual, expectedMap["UI"])
 				})
 
-			Convey("Walking the type should return a map of all the visible simple key-values that user defines if expand is *", func() {
+			Convey("Walking the type should return a map of all the visible simple and time key-values that user defines if expand is *", func() {
 					simpleWithTime := SimpleWithTime{Name: "foo", Time: time.Now()}
 					expectedMap := make(map[string]string)
 					expectedMap["Name"] = simpleWithTime.Name
@@ -79,8 +87,8 @@ func TestExpander(t *testing.T) {
 					singleMultiLevel := SimpleMultiLevel{expectedMap["SI"].([]int), expectedMap["MSB"].(map[string]bool)}
 					result := Expand(singleMultiLevel, "*", "")
 
-					So(result["SI"], ShouldContain, 1)
-					So(result["SI"], ShouldContain, 2)
+					// the walker gives every int as int64
+					So(result["SI"], ShouldResemble, []interface{}{int64(1), int64(2)})
 
 					msb := result["MSB"].(map[string]interface{})
 					for k, v := range msb {
@@ -544,20 +552,17 @@ func TestExpander(t *testing.T) {
 					uris := map[string]string{simple.Ref.Collection: "http://some-uri/id"}
 
 					ExpanderConfig = Configuration{UsingMongo: true, IdURIs: uris}
-					mockedFn := getContentFrom
-					getContentFrom = func(url *url.URL) string {
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
 						result, _ := json.Marshal(info)
-						return string(result)
-					}
+						return result, nil
+					})
 
-					result := Expand(simple, "*", "")
+					result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).Expand(simple, "*", "")
 					mongoRef := result["Ref"].(map[string]interface{})
 
 					So(result["name"], ShouldEqual, simple.Name)
 					So(mongoRef["Name"], ShouldEqual, info.Name)
 					So(mongoRef["Age"], ShouldEqual, info.Age)
-
-					getContentFrom = mockedFn
 				})
 
 			Convey("Fetching should return a list of underlying values when Mongo flag is set to true with proper IdURIs", func() {
@@ -575,13 +580,12 @@ func TestExpander(t *testing.T) {
 				}
 
 					ExpanderConfig = Configuration{UsingMongo: true, IdURIs: uris}
-					mockedFn := getContentFrom
-					getContentFrom = func(url *url.URL) string {
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
 						result, _ := json.Marshal(info)
-						return string(result)
-					}
+						return result, nil
+					})
 
-					result := Expand(simple, "*", "")
+					result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).Expand(simple, "*", "")
 					mongoRef := result["Refs"].([]interface{})
 					child1 := mongoRef[0].(map[string]interface{})
 					child2 := mongoRef[1].(map[string]interface{})
@@ -591,8 +595,6 @@ func TestExpander(t *testing.T) {
 					So(child1["Age"], ShouldEqual, info.Age)
 					So(child2["Name"], ShouldEqual, info.Name)
 					So(child2["Age"], ShouldEqual, info.Age)
-
-					getContentFrom = mockedFn
 				})
 
 		})
@@ -602,19 +604,16 @@ func TestExpander(t *testing.T) {
 					singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}}
 					info := Info{"A name", 100}
 
-					mockedFn := getContentFrom
-					getContentFrom = func(url *url.URL) string {
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
 						result, _ := json.Marshal(info)
-						return string(result)
-					}
+						return result, nil
+					})
 
-					result := Expand(singleLevel, "*,((", "")
+					result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).Expand(singleLevel, "*,((", "")
 					actual := result["L"].(map[string]interface{})
 
 					//still same after expansion, because filter is invalid
 					So(actual["ref"], ShouldEqual, singleLevel.L.Ref)
-
-					getContentFrom = mockedFn
 				})
 
 			Convey("open brackets shouldbe handled as invalid filter and not apply filter", func() {
@@ -642,7 +641,7 @@ func TestExpander(t *testing.T) {
 					So(actual["verb"], ShouldEqual, singleLevel.L.Verb)
 				})
 
-			Convey("Fetching should return the same value when non-URI data structure given", func() {
+			Convey("Fetching should keep the rel and verb of a link whose ref is not a URI", func() {
 					singleLevel := SimpleSingleLevel{L: Link{Ref: "non-URI", Rel: "nothing", Verb: "GET"}}
 
 					result := Expand(singleLevel, "*", "")
@@ -657,19 +656,32 @@ func TestExpander(t *testing.T) {
 					singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}}
 					info := Info{"A name", 100}
 
-					mockedFn := getContentFrom
-					getContentFrom = func(url *url.URL) string {
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
 						result, _ := json.Marshal(info)
-						return string(result)
-					}
+						return result, nil
+					})
 
-					result := Expand(singleLevel, "*", "")
+					result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).Expand(singleLevel, "*", "")
 					actual := result["L"].(map[string]interface{})
 
 					So(actual["Name"], ShouldEqual, info.Name)
 					So(actual["Age"], ShouldEqual, info.Age)
+				})
 
-					getContentFrom = mockedFn
+			Convey("Fetching should hand the whole link to the Fetcher", func() {
+					singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}}
+					var fetched Reference
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						fetched = ref
+						return []byte("{}"), nil
+					})
+
+					New(WithFetcher(fetcher)).Expand(singleLevel, "*", "")
+
+					So(fetched.Ref, ShouldEqual, singleLevel.L.Ref)
+					So(fetched.Rel, ShouldEqual, singleLevel.L.Rel)
+					So(fetched.Verb, ShouldEqual, singleLevel.L.Verb)
 				})
 
 			Convey("Fetching should replace an array of values with expanded data structures when valid URIs given", func() {
@@ -683,17 +695,16 @@ func TestExpander(t *testing.T) {
 					Info{"Another name", 200},
 				}
 
-					mockedFn := getContentFrom
-					index := 0
-					getContentFrom = func(url *url.URL) string {
-						result, _ := json.Marshal(info[index])
-						index = index+1
-						return string(result)
-					}
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						if ref.Ref == links[0].Ref {
+							return json.Marshal(info[0])
+						}
+						return json.Marshal(info[1])
+					})
 
 					simpleWithLinks := SimpleWithLinks{"something", links}
 
-					result := Expand(simpleWithLinks, "*", "")
+					result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).Expand(simpleWithLinks, "*", "")
 					members := result["Members"].([]interface{})
 
 					So(result["Name"], ShouldEqual, simpleWithLinks.Name)
@@ -704,8 +715,6 @@ func TestExpander(t *testing.T) {
 						So(member["Name"], ShouldEqual, info[i].Name)
 						So(member["Age"], ShouldEqual, info[i].Age)
 					}
-
-					getContentFrom = mockedFn
 				})
 
 			Convey("Fetching should replace the value recursively with expanded data structure when valid URIs given", func() {
@@ -713,20 +722,14 @@ func TestExpander(t *testing.T) {
 					singleLevel2 := SimpleSingleLevel{S: "two", L: Link{Ref: "http://valid2/info", Rel: "nothing2", Verb: "GET"}}
 					info := Info{"A name", 100}
 
-					mockedFn := getContentFrom
-					index := 0
-					getContentFrom = func(url *url.URL) string {
-						var result []byte
-						if index > 0 {
-							result, _ = json.Marshal(info)
-							return string(result)
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						if ref.Ref == singleLevel2.L.Ref {
+							return json.Marshal(info)
 						}
-						result, _ = json.Marshal(singleLevel2)
-						index = index+1
-						return string(result)
-					}
+						return json.Marshal(singleLevel2)
+					})
 
-					result := Expand(singleLevel1, "*", "")
+					result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).Expand(singleLevel1, "*", "")
 					parent := result["L"].(map[string]interface{})
 					child := parent["L"].(map[string]interface{})
 
@@ -734,22 +737,19 @@ func TestExpander(t *testing.T) {
 					So(parent["S"], ShouldEqual, singleLevel2.S)
 					So(child["Name"], ShouldEqual, info.Name)
 					So(child["Age"], ShouldEqual, info.Age)
-
-					getContentFrom = mockedFn
 				})
 
 			Convey("Expanding should replace the value recursively and filter the expanded data structure when valid URIs given", func() {
 					singleLevel1 := SimpleSingleLevel{S: "one", L: Link{Ref: "http://valid1/ssl", Rel: "nothing1", Verb: "GET"}}
 					singleLevel2 := SimpleSingleLevel{S: "two", L: Link{Ref: "http://valid2/info", Rel: "nothing2", Verb: "GET"}}
 
-					mockedFn := getContentFrom
-					getContentFrom = func(url *url.URL) string {
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
 						var result []byte
 						result, _ = json.Marshal(singleLevel2)
-						return string(result)
-					}
+						return result, nil
+					})
 
-					result := Expand(singleLevel1, "L", "")
+					result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).Expand(singleLevel1, "L", "")
 					parent := result["L"].(map[string]interface{})
 					child := parent["L"].(map[string]interface{})
 
@@ -758,34 +758,27 @@ func TestExpander(t *testing.T) {
 					So(child["ref"], ShouldEqual, singleLevel2.L.Ref)
 					So(child["rel"], ShouldEqual, singleLevel2.L.Rel)
 					So(child["verb"], ShouldEqual, singleLevel2.L.Verb)
-
-					getContentFrom = mockedFn
 				})
 
 			Convey("Expanding should replace the value recursively and filter the expanded data structure when data contains a list of nested sub-types", func() {
 					link1 := Link{Ref: "http://valid1/ssl", Rel: "nothing1", Verb: "GET"}
 					link2 := Link{Ref: "http://valid2/ssl", Rel: "nothing2", Verb: "GET"}
-					singleLevel := SimpleSingleLevel{S: "one", L: link1}
+					infoLink := Link{Ref: "http://valid3/info", Rel: "nothing3", Verb: "GET"}
+					singleLevel := SimpleSingleLevel{S: "one", L: infoLink}
 					info := Info{"A name", 100}
 					simpleWithLinks := SimpleWithLinks{
 					Name:    "lorem",
 					Members: []Link{link1, link2},
 				}
 
-					mockedFn := getContentFrom
-					index := 0
-					getContentFrom = func(url *url.URL) string {
-						var result []byte
-						index = index+1
-						if index%2 == 0 {
-							result, _ = json.Marshal(info)
-							return string(result)
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						if ref.Ref == infoLink.Ref {
+							return json.Marshal(info)
 						}
-						result, _ = json.Marshal(singleLevel)
-						return string(result)
-					}
+						return json.Marshal(singleLevel)
+					})
 
-					result := Expand(simpleWithLinks, "Members(L)", "Name,Members(S,L)")
+					result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).Expand(simpleWithLinks, "Members(L)", "Name,Members(S,L)")
 					parent := result["Members"].([]interface{})
 
 					So(len(result), ShouldEqual, 2)
@@ -795,8 +788,6 @@ func TestExpander(t *testing.T) {
 
 					actualLink := child1["L"].(map[string]interface{})
 					So(actualLink["Name"], ShouldEqual, info.Name)
-
-					getContentFrom = mockedFn
 				})
 
 
@@ -850,27 +841,24 @@ func TestExpander(t *testing.T) {
 							uris := map[string]string{item1.Collection: "http://some-uri/id"}
 
 							ExpanderConfig = Configuration{UsingMongo: true, IdURIs: uris}
-							mockedFn := getContentFrom
-							getContentFrom = func(url *url.URL) string {
-								fmt.Println(url)
-								if url.Path == "/id/123" {
+							fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+								uri, _ := url.Parse(ref.Ref)
+								if uri.Path == "/id/123" {
 									result, _ := json.Marshal(info1)
-									return string(result)
+									return result, nil
 								} else {
 									result, _ := json.Marshal(info2)
-									return string(result)
+									return result, nil
 								}
-							}
+							})
 
-							result := ExpandArray(items, "*", "")
+							result := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).ExpandArray(items, "*", "")
 							So(len(result), ShouldEqual, len(infos))
 
 							result1 := result[0].(map[string]interface{})
 							result2 := result[1].(map[string]interface{})
 							So(result1["Name"], ShouldEqual, info1.Name)
 							So(result2["Name"], ShouldEqual, info2.Name)
-
-							getContentFrom = mockedFn
 						})
 				})
 			Convey("When caching is enabled, it should emit a second call to the same URI of a valid reference", func() {
@@ -880,67 +868,883 @@ func TestExpander(t *testing.T) {
 							singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}}
 							info := Info{"A name", 100}
 
-							mockedFn := getContentFrom
-							makeGetCall = func(url *url.URL) string {
+							fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
 								result, _ := json.Marshal(info)
-								return string(result)
-							}
+								return result, nil
+							})
 
-							result := Expand(singleLevel, "*", "")
+							result := New(WithConfiguration(ExpanderConfig), WithCache(DefaultCache), WithFetcher(fetcher)).Expand(singleLevel, "*", "")
 							actual := result["L"].(map[string]interface{})
 
 							So(actual["Name"], ShouldEqual, info.Name)
 							So(actual["Age"], ShouldEqual, info.Age)
-
-							makeGetCall = mockedFn
 						})
 					Convey("Fetching a valid Reference second time should NOT make GET call and replace the data correctly", func() {
 							singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}}
 							info := Info{"A name", 100}
 
-							mockedFn := getContentFrom
-							makeGetCall = func(url *url.URL) string {
+							fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
 								//this should not be called, so return invalid data to make the test fail in case it is called:
-								return "INVALID_DATA"
-							}
+								return []byte("INVALID_DATA"), nil
+							})
 
-							result := Expand(singleLevel, "*", "")
+							result := New(WithConfiguration(ExpanderConfig), WithCache(DefaultCache), WithFetcher(fetcher)).Expand(singleLevel, "*", "")
 							actual := result["L"].(map[string]interface{})
 
 							So(actual["Name"], ShouldEqual, info.Name)
 							So(actual["Age"], ShouldEqual, info.Age)
-
-							makeGetCall = mockedFn
 						})
 					Convey("Fetching Reference second/third/... time should make GET call when cached data is older then 24h and replace the data correctly", func() {
 							uri := "http://valid"
 							singleLevel := SimpleSingleLevel{L: Link{Ref: uri, Rel: "nothing", Verb: "GET"}}
 							info := Info{"A name", 100}
 
-							expiredTimestamp := time.Now().Unix() - (ExpanderConfig.CacheExpInSeconds + 1)
 							invalidData := "INVALID_DATA"
 
-							Cache.Remove(uri)
-							Cache.Add(uri, CacheEntry{Timestamp: expiredTimestamp, Data: invalidData})
+							DefaultCache.Set(uri, []byte(invalidData), time.Millisecond)
+							time.Sleep(2 * time.Millisecond)
 
 
-							mockedFn := getContentFrom
-							makeGetCall = func(url *url.URL) string {
+							fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
 								result, _ := json.Marshal(info)
-								return string(result)
-							}
+								return result, nil
+							})
 
-							result := Expand(singleLevel, "*", "")
+							result := New(WithConfiguration(ExpanderConfig), WithCache(DefaultCache), WithFetcher(fetcher)).Expand(singleLevel, "*", "")
 							actual := result["L"].(map[string]interface{})
 
 							So(actual["Name"], ShouldEqual, info.Name)
 							So(actual["Age"], ShouldEqual, info.Age)
-
-							makeGetCall = mockedFn
 						})
 				})
 			ExpanderConfig.UsingCache = false
 		})
+
+	Convey("It should honor the caching headers of the downstream services:", t, func() {
+			var calls, conditionalCalls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				switch r.URL.Path {
+				case "/max-age":
+					w.Header().Set("Cache-Control", "max-age=60")
+				case "/no-store":
+					w.Header().Set("Cache-Control", "no-store")
+				case "/etag":
+					w.Header().Set("Cache-Control", "no-cache")
+					w.Header().Set("ETag", `"v1"`)
+					if r.Header.Get("If-None-Match") == `"v1"` {
+						atomic.AddInt32(&conditionalCalls, 1)
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+				case "/last-modified":
+					w.Header().Set("Cache-Control", "max-age=0")
+					w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+					if r.Header.Get("If-Modified-Since") != "" {
+						atomic.AddInt32(&conditionalCalls, 1)
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"Name": "A name", "Age": 100}`))
+			}))
+			defer server.Close()
+
+			expandTwice := func(path string) (map[string]interface{}, map[string]interface{}) {
+				singleLevel := SimpleSingleLevel{L: Link{Ref: server.URL + path, Rel: "nothing", Verb: "GET"}}
+				expander := New(WithConfiguration(Configuration{UsingCache: true, CacheExpInSeconds: 60}))
+
+				first := expander.Expand(singleLevel, "*", "")
+				second := expander.Expand(singleLevel, "*", "")
+				return first["L"].(map[string]interface{}), second["L"].(map[string]interface{})
+			}
+
+			Convey("Fetching a resource with max-age should serve it from the cache while it is fresh", func() {
+					first, second := expandTwice("/max-age")
+
+					So(first["Name"], ShouldEqual, "A name")
+					So(second["Name"], ShouldEqual, "A name")
+					So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+				})
+
+			Convey("Fetching a resource with no-store should not cache it", func() {
+					_, second := expandTwice("/no-store")
+
+					So(second["Name"], ShouldEqual, "A name")
+					So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+				})
+
+			Convey("Fetching an expired resource with an ETag should revalidate it with If-None-Match", func() {
+					first, second := expandTwice("/etag")
+
+					So(first["Name"], ShouldEqual, "A name")
+					So(second["Name"], ShouldEqual, "A name")
+					So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+					So(atomic.LoadInt32(&conditionalCalls), ShouldEqual, 1)
+				})
+
+			Convey("Fetching an expired resource with a Last-Modified should revalidate it with If-Modified-Since", func() {
+					_, second := expandTwice("/last-modified")
+
+					So(second["Name"], ShouldEqual, "A name")
+					So(atomic.LoadInt32(&conditionalCalls), ShouldEqual, 1)
+				})
+		})
+
+	Convey("It should serve expired entries from the cache when configured to:", t, func() {
+			uri := "http://valid/stale"
+			singleLevel := SimpleSingleLevel{L: Link{Ref: uri, Rel: "nothing", Verb: "GET"}}
+			cache := NewLRUCache(10)
+			expired, _ := json.Marshal(cachedResource{Content: []byte(`{"Name": "old"}`), FreshUntil: time.Now().Add(-time.Second)})
+			cache.Set(uri, expired, time.Minute)
+
+			Convey("Expanding with CacheStaleWhileRevalidateInSeconds should return the expired entry and refresh it in the background", func() {
+					refreshed := make(chan bool, 1)
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						refreshed <- true
+						return []byte(`{"Name": "new"}`), nil
+					})
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60, CacheStaleWhileRevalidateInSeconds: 60}
+
+					result := New(WithConfiguration(config), WithCache(cache), WithFetcher(fetcher)).Expand(singleLevel, "*", "")
+
+					So(result["L"].(map[string]interface{})["Name"], ShouldEqual, "old")
+					select {
+					case <-refreshed:
+					case <-time.After(time.Second):
+						So("no refresh within a second", ShouldBeEmpty)
+					}
+
+					// the refresh stores the new content right after the fetch
+					var resource cachedResource
+					for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+						value, _ := cache.Get(uri)
+						json.Unmarshal(value, &resource)
+						if string(resource.Content) == `{"Name":"new"}` {
+							break
+						}
+					}
+					So(string(resource.Content), ShouldEqual, `{"Name":"new"}`)
+					So(resource.FreshUntil, ShouldHappenAfter, time.Now().Add(50*time.Second))
+				})
+
+			Convey("Expanding with CacheStaleWhileRevalidateInSeconds should not refresh an entry again while its refresh failure is cached", func() {
+					var calls int32
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						atomic.AddInt32(&calls, 1)
+						return nil, &FetchError{URI: ref.Ref, StatusCode: http.StatusServiceUnavailable, Err: errors.New("unavailable")}
+					})
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60, CacheStaleWhileRevalidateInSeconds: 60, CacheFailuresForInSeconds: 60}
+					expander := New(WithConfiguration(config), WithCache(cache), WithFetcher(fetcher))
+
+					for i := 0; i < 5; i++ {
+						result := expander.Expand(singleLevel, "*", "")
+						So(result["L"].(map[string]interface{})["Name"], ShouldEqual, "old")
+					}
+					time.Sleep(50 * time.Millisecond)
+
+					So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+				})
+
+			Convey("Expanding with CacheStaleIfErrorInSeconds should return the expired entry when refreshing it fails", func() {
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						return nil, &FetchError{URI: ref.Ref, StatusCode: http.StatusServiceUnavailable, Err: errors.New("unavailable")}
+					})
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60, CacheStaleIfErrorInSeconds: 60}
+
+					result, err := New(WithConfiguration(config), WithCache(cache), WithFetcher(fetcher)).ExpandE(singleLevel, "*", "")
+
+					So(err, ShouldBeNil)
+					So(result["L"].(map[string]interface{})["Name"], ShouldEqual, "old")
+				})
+
+			Convey("Expanding without stale modes should not return the expired entry", func() {
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						return nil, &FetchError{URI: ref.Ref, StatusCode: http.StatusServiceUnavailable, Err: errors.New("unavailable")}
+					})
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60}
+
+					result, err := New(WithConfiguration(config), WithCache(cache), WithFetcher(fetcher)).ExpandE(singleLevel, "*", "")
+
+					So(err, ShouldNotBeNil)
+					So(result["L"].(map[string]interface{})["ref"], ShouldEqual, uri)
+				})
+		})
+
+	Convey("It should cache failed lookups when configured to:", t, func() {
+			uri := "http://valid/broken"
+			singleLevel := SimpleSingleLevel{L: Link{Ref: uri, Rel: "nothing", Verb: "GET"}}
+			var calls int32
+			fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+				atomic.AddInt32(&calls, 1)
+				return nil, &FetchError{URI: ref.Ref, StatusCode: http.StatusNotFound, Err: errors.New("Not Found")}
+			})
+
+			Convey("Expanding a broken reference twice with CacheFailuresForInSeconds should fetch it only once", func() {
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60, CacheFailuresForInSeconds: 10}
+					expander := New(WithConfiguration(config), WithFetcher(fetcher))
+
+					expander.ExpandE(singleLevel, "*", "")
+					result, err := expander.ExpandE(singleLevel, "*", "")
+					var fetchErr *FetchError
+
+					So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+					So(result["L"].(map[string]interface{})["ref"], ShouldEqual, uri)
+					So(errors.Is(err, ErrCachedFailure), ShouldBeTrue)
+					So(errors.As(err, &fetchErr), ShouldBeTrue)
+					So(fetchErr.StatusCode, ShouldEqual, http.StatusNotFound)
+				})
+
+			Convey("Expanding a broken reference twice without CacheFailuresForInSeconds should fetch it every time", func() {
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60}
+					expander := New(WithConfiguration(config), WithFetcher(fetcher))
+
+					expander.ExpandE(singleLevel, "*", "")
+					expander.ExpandE(singleLevel, "*", "")
+
+					So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+				})
+
+			Convey("Expanding a broken reference with an expired entry should keep serving the entry stale", func() {
+					cache := NewLRUCache(10)
+					expired, _ := json.Marshal(cachedResource{Content: []byte(`{"Name": "old"}`), FreshUntil: time.Now().Add(-time.Second)})
+					cache.Set(uri, expired, time.Minute)
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60, CacheFailuresForInSeconds: 10, CacheStaleIfErrorInSeconds: 60}
+					expander := New(WithConfiguration(config), WithCache(cache), WithFetcher(fetcher))
+
+					expander.Expand(singleLevel, "*", "")
+					result := expander.Expand(singleLevel, "*", "")
+
+					So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+					So(result["L"].(map[string]interface{})["Name"], ShouldEqual, "old")
+				})
+		})
+
+	Convey("It should take the freshness of a response from its caching headers:", t, func() {
+			now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+			fallback := time.Hour
+
+			Convey("Reading s-maxage should take precedence over max-age", func() {
+					header := http.Header{"Cache-Control": {"public, max-age=60, s-maxage=120"}}
+
+					So(cachePolicyOf(header, fallback, now).freshFor, ShouldEqual, 120*time.Second)
+				})
+
+			Convey("Reading Expires should count from the Date of the response", func() {
+					header := http.Header{
+						"Date":    {"Mon, 02 Jan 2006 15:00:00 GMT"},
+						"Expires": {"Mon, 02 Jan 2006 15:10:00 GMT"},
+					}
+
+					So(cachePolicyOf(header, fallback, now).freshFor, ShouldEqual, 10*time.Minute)
+				})
+
+			Convey("Reading an invalid Expires should make the response expired", func() {
+					header := http.Header{"Expires": {"0"}}
+
+					So(cachePolicyOf(header, fallback, now).freshFor, ShouldEqual, 0)
+				})
+
+			Convey("Reading private or no-store should not store the response", func() {
+					So(cachePolicyOf(http.Header{"Cache-Control": {"private, max-age=60"}}, fallback, now).noStore, ShouldBeTrue)
+					So(cachePolicyOf(http.Header{"Cache-Control": {"no-store"}}, fallback, now).noStore, ShouldBeTrue)
+				})
+
+			Convey("Reading no caching headers should fall back to CacheExpInSeconds", func() {
+					So(cachePolicyOf(http.Header{}, fallback, now).freshFor, ShouldEqual, fallback)
+				})
+		})
+
+	Convey("It should return the errors it runs into during expansion:", t, func() {
+			Convey("Expanding with a useless configuration should report it through ConfigurationErrors, not as an expansion error", func() {
+					singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}}
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						return json.Marshal(Info{"A name", 100})
+					})
+
+					stdout := os.Stdout
+					reader, writer, _ := os.Pipe()
+					os.Stdout = writer
+					expander := New(WithConfiguration(Configuration{UsingCache: true}), WithFetcher(fetcher))
+					os.Stdout = stdout
+					writer.Close()
+					printed, _ := io.ReadAll(reader)
+
+					result, err := expander.ExpandE(singleLevel, "*", "")
+
+					So(string(printed), ShouldBeEmpty)
+					So(err, ShouldBeNil)
+					So(result["L"].(map[string]interface{})["Name"], ShouldEqual, "A name")
+					So(errors.Is(expander.ConfigurationErrors(), ErrCacheWithoutExpiration), ShouldBeTrue)
+					So(New().ConfigurationErrors(), ShouldBeNil)
+				})
+
+			Convey("Expanding with invalid filters should return a FilterSyntaxError with the position", func() {
+					singleLevel := SimpleSingleLevel{S: "bar"}
+
+					result, err := ExpandE(singleLevel, "", "S,L(ref")
+					syntaxErr, ok := err.(*FilterSyntaxError)
+
+					So(result, ShouldBeNil)
+					So(ok, ShouldBeTrue)
+					So(syntaxErr.Filter, ShouldEqual, "S,L(ref")
+					So(syntaxErr.Position, ShouldEqual, 3)
+
+					_, err = ExpandE(singleLevel, "L)", "")
+					syntaxErr, ok = err.(*FilterSyntaxError)
+
+					So(ok, ShouldBeTrue)
+					So(syntaxErr.Position, ShouldEqual, 1)
+				})
+
+			Convey("Expanding should return the partial result and all the failed references as ExpansionErrors", func() {
+					links := []Link{
+					Link{"http://unreachable", "relation1", "GET"},
+					Link{"http://not-json", "relation2", "GET"},
+					Link{"http://valid", "relation3", "GET"},
+				}
+					info := Info{"A name", 100}
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						uri, _ := url.Parse(ref.Ref)
+						switch uri.Host {
+						case "unreachable":
+							return nil, &FetchError{URI: ref.Ref, Err: fmt.Errorf("connection refused")}
+						case "not-json":
+							return []byte("<html></html>"), nil
+						}
+						result, _ := json.Marshal(info)
+						return result, nil
+					})
+
+					result, err := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).ExpandE(SimpleWithLinks{"something", links}, "*", "")
+					members := result["Members"].([]interface{})
+					errs, ok := err.(ExpansionErrors)
+
+					So(ok, ShouldBeTrue)
+					So(len(errs), ShouldEqual, 2)
+					for _, err := range errs {
+						switch err := err.(type) {
+						case *FetchError:
+							So(err.URI, ShouldEqual, "http://unreachable")
+						case *DecodeError:
+							So(err.URI, ShouldEqual, "http://not-json")
+						default:
+							So(err, ShouldBeNil)
+						}
+					}
+
+					So(members[0].(Link).Ref, ShouldEqual, links[0].Ref)
+					So(members[1].(Link).Ref, ShouldEqual, links[1].Ref)
+					So(members[2].(map[string]interface{})["Name"], ShouldEqual, info.Name)
+				})
+
+			Convey("Expanding without any problems should not return an error", func() {
+					singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}}
+					info := Info{"A name", 100}
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						result, _ := json.Marshal(info)
+						return result, nil
+					})
+
+					result, err := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).ExpandArrayE([]SimpleSingleLevel{singleLevel}, "*", "")
+
+					So(err, ShouldBeNil)
+					So(result[0].(map[string]interface{})["L"].(map[string]interface{})["Name"], ShouldEqual, info.Name)
+				})
+		})
+
+	Convey("It should stop fetching references when the context is done:", t, func() {
+			Convey("Expanding with a cancelled context should not fetch anything and return the cancellation", func() {
+					singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}}
+					calls := 0
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						calls = calls+1
+						return []byte("{}"), nil
+					})
+
+					ctx, cancel := context.WithCancel(context.Background())
+					cancel()
+					result, err := New(WithConfiguration(ExpanderConfig), WithFetcher(fetcher)).ExpandContext(ctx, singleLevel, "*", "")
+					actual := result["L"].(map[string]interface{})
+
+					So(calls, ShouldEqual, 0)
+					So(errors.Is(err.(ExpansionErrors)[0], context.Canceled), ShouldBeTrue)
+					So(actual["ref"], ShouldEqual, singleLevel.L.Ref)
+				})
+
+			Convey("Expanding should abort a running fetch when the deadline passes", func() {
+					server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						select {
+						case <-r.Context().Done():
+						case <-time.After(5 * time.Second):
+						}
+					}))
+					defer server.Close()
+
+					singleLevel := SimpleSingleLevel{L: Link{Ref: server.URL, Rel: "nothing", Verb: "GET"}}
+					ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+					defer cancel()
+
+					started := time.Now()
+					result, err := New().ExpandContext(ctx, singleLevel, "*", "")
+					actual := result["L"].(map[string]interface{})
+					errs := err.(ExpansionErrors)
+
+					So(time.Since(started), ShouldBeLessThan, time.Second)
+					So(len(errs), ShouldEqual, 1)
+					So(errors.Is(errs[0], context.DeadlineExceeded), ShouldBeTrue)
+					So(actual["ref"], ShouldEqual, server.URL)
+				})
+		})
+
+	Convey("It should resolve sibling references concurrently:", t, func() {
+			Convey("Expanding should fetch the items of a list in parallel up to MaxConcurrentFetches and keep their order", func() {
+					var links []Link
+					for i := 0; i < 20; i++ {
+						links = append(links, Link{fmt.Sprintf("http://valid/%v", i), "member", "GET"})
+					}
+
+					var inFlight, maxInFlight int32
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						current := atomic.AddInt32(&inFlight, 1)
+						for {
+							seen := atomic.LoadInt32(&maxInFlight)
+							if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+								break
+							}
+						}
+						time.Sleep(10 * time.Millisecond)
+						atomic.AddInt32(&inFlight, -1)
+
+						return json.Marshal(Info{ref.Ref, 100})
+					})
+
+					expander := New(WithConfiguration(Configuration{MaxConcurrentFetches: 4}), WithFetcher(fetcher))
+					result := expander.Expand(SimpleWithLinks{"something", links}, "*", "")
+					members := result["Members"].([]interface{})
+
+					So(maxInFlight, ShouldBeGreaterThan, 1)
+					So(maxInFlight, ShouldBeLessThanOrEqualTo, 4)
+					So(len(members), ShouldEqual, len(links))
+					for i, member := range members {
+						So(member.(map[string]interface{})["Name"], ShouldEqual, links[i].Ref)
+					}
+				})
+
+			Convey("Expanding an array should resolve the items in parallel and keep their order", func() {
+					var items []SimpleSingleLevel
+					for i := 0; i < 10; i++ {
+						items = append(items, SimpleSingleLevel{I: i, L: Link{fmt.Sprintf("http://valid/%v", i), "item", "GET"}})
+					}
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						return json.Marshal(Info{ref.Ref, 100})
+					})
+
+					result := New(WithFetcher(fetcher)).ExpandArray(items, "*", "")
+
+					So(len(result), ShouldEqual, len(items))
+					for i, item := range result {
+						actual := item.(map[string]interface{})
+						So(actual["I"], ShouldEqual, i)
+						So(actual["L"].(map[string]interface{})["Name"], ShouldEqual, items[i].L.Ref)
+					}
+				})
+		})
+
+	Convey("It should collapse concurrent fetches of the same reference:", t, func() {
+			Convey("Expanding an array pointing to the same URI should fetch it only once while it is in flight", func() {
+					group := Link{"http://valid/groups/7", "group", "GET"}
+					var items []SimpleSingleLevel
+					for i := 0; i < 20; i++ {
+						items = append(items, SimpleSingleLevel{I: i, L: group})
+					}
+
+					var calls int32
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						atomic.AddInt32(&calls, 1)
+						time.Sleep(100 * time.Millisecond)
+						return json.Marshal(Info{"Family", 7})
+					})
+
+					expander := New(WithConfiguration(Configuration{MaxConcurrentFetches: 20}), WithFetcher(fetcher))
+					result := expander.ExpandArray(items, "*", "")
+
+					So(calls, ShouldEqual, 1)
+					for _, item := range result {
+						So(item.(map[string]interface{})["L"].(map[string]interface{})["Name"], ShouldEqual, "Family")
+					}
+				})
+
+			Convey("Expanding concurrently with the same instance should share the fetch of the same URI", func() {
+					singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid/shared", Rel: "nothing", Verb: "GET"}}
+
+					var calls int32
+					started := make(chan bool)
+					release := make(chan bool)
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						if atomic.AddInt32(&calls, 1) == 1 {
+							close(started)
+						}
+						<-release
+						return json.Marshal(Info{"A name", 100})
+					})
+
+					expander := New(WithConfiguration(Configuration{UsingCache: true, CacheExpInSeconds: 60}), WithFetcher(fetcher))
+					results := make([]map[string]interface{}, 2)
+					var wg sync.WaitGroup
+					for i := range results {
+						wg.Add(1)
+						go func(i int) {
+							defer wg.Done()
+							results[i] = expander.Expand(singleLevel, "*", "")
+						}(i)
+					}
+
+					<-started
+					time.Sleep(50 * time.Millisecond)
+					close(release)
+					wg.Wait()
+
+					So(calls, ShouldEqual, 1)
+					So(results[0]["L"].(map[string]interface{})["Name"], ShouldEqual, "A name")
+					So(results[1]["L"].(map[string]interface{})["Name"], ShouldEqual, "A name")
+				})
+		})
+
+	Convey("It should stop expanding recursively at cycles and at the maximum depth:", t, func() {
+			Convey("Expanding references pointing back to each other should leave the repeated one as a link", func() {
+					singleLevel := SimpleSingleLevel{S: "root", L: Link{Ref: "http://valid/a", Rel: "first", Verb: "GET"}}
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						if ref.Ref == "http://valid/a" {
+							return []byte(`{"name": "a", "next": {"ref": "http://valid/b", "rel": "next"}}`), nil
+						}
+						return []byte(`{"name": "b", "next": {"ref": "http://valid/a", "rel": "next"}}`), nil
+					})
+
+					result := New(WithFetcher(fetcher)).Expand(singleLevel, "*", "")
+					a := result["L"].(map[string]interface{})
+					b := a["next"].(map[string]interface{})
+					backToA := b["next"].(map[string]interface{})
+
+					So(a["name"], ShouldEqual, "a")
+					So(b["name"], ShouldEqual, "b")
+					So(backToA["ref"], ShouldEqual, "http://valid/a")
+					So(backToA["rel"], ShouldEqual, "next")
+					So(backToA[STOPPED_KEY], ShouldEqual, STOPPED_BY_CYCLE)
+				})
+
+			Convey("Expanding an endless chain of references should stop at MaxExpansionDepth", func() {
+					singleLevel := SimpleSingleLevel{S: "root", L: Link{Ref: "http://valid/1", Rel: "next", Verb: "GET"}}
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						var current int
+						fmt.Sscanf(ref.Ref, "http://valid/%d", &current)
+						return []byte(fmt.Sprintf(`{"id": %v, "next": {"ref": "http://valid/%v"}}`, current, current+1)), nil
+					})
+
+					result := New(WithConfiguration(Configuration{MaxExpansionDepth: 3}), WithFetcher(fetcher)).Expand(singleLevel, "*", "")
+					first := result["L"].(map[string]interface{})
+					second := first["next"].(map[string]interface{})
+					third := second["next"].(map[string]interface{})
+					fourth := third["next"].(map[string]interface{})
+
+					So(first["id"], ShouldEqual, 1)
+					So(second["id"], ShouldEqual, 2)
+					So(third["id"], ShouldEqual, 3)
+					So(fourth["id"], ShouldBeNil)
+					So(fourth["ref"], ShouldEqual, "http://valid/4")
+					So(fourth[STOPPED_KEY], ShouldEqual, STOPPED_BY_MAX_DEPTH)
+				})
+
+			Convey("Expanding the same reference in sibling branches should not be handled as a cycle", func() {
+					links := []Link{
+					Link{"http://valid/same", "first", "GET"},
+					Link{"http://valid/same", "second", "GET"},
+				}
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						return json.Marshal(Info{"A name", 100})
+					})
+
+					result := New(WithFetcher(fetcher)).Expand(SimpleWithLinks{"something", links}, "*", "")
+					members := result["Members"].([]interface{})
+
+					So(members[0].(map[string]interface{})["Name"], ShouldEqual, "A name")
+					So(members[1].(map[string]interface{})["Name"], ShouldEqual, "A name")
+				})
+		})
+
+	Convey("It should stop fetching when the budget of the expansion is used up:", t, func() {
+			chain := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+				var current int
+				fmt.Sscanf(ref.Ref, "http://valid/%d", &current)
+				return []byte(fmt.Sprintf(`{"id": %v, "next": {"ref": "http://valid/%v"}}`, current, current+1)), nil
+			})
+
+			Convey("Expanding with MaxFetches should leave the remaining references as links and report the usage", func() {
+					singleLevel := SimpleSingleLevel{S: "root", L: Link{Ref: "http://valid/1", Rel: "next", Verb: "GET"}}
+
+					expander := New(WithConfiguration(Configuration{MaxFetches: 2}), WithFetcher(chain))
+					result, usage, err := expander.ExpandWithUsage(context.Background(), singleLevel, "*", "")
+					first := result["L"].(map[string]interface{})
+					second := first["next"].(map[string]interface{})
+					third := second["next"].(map[string]interface{})
+
+					So(err, ShouldBeNil)
+					So(first["id"], ShouldEqual, 1)
+					So(second["id"], ShouldEqual, 2)
+					So(third["id"], ShouldBeNil)
+					So(third["ref"], ShouldEqual, "http://valid/3")
+					So(third[STOPPED_KEY], ShouldEqual, STOPPED_BY_MAX_FETCHES)
+					So(usage.Fetches, ShouldEqual, 2)
+					So(usage.Skipped, ShouldEqual, 1)
+					So(usage.Bytes, ShouldBeGreaterThan, 0)
+				})
+
+			Convey("Expanding with MaxBytes should stop fetching once the fetched bytes reach the limit", func() {
+					singleLevel := SimpleSingleLevel{S: "root", L: Link{Ref: "http://valid/1", Rel: "next", Verb: "GET"}}
+
+					expander := New(WithConfiguration(Configuration{MaxBytes: 1}), WithFetcher(chain))
+					result, usage, _ := expander.ExpandWithUsage(context.Background(), singleLevel, "*", "")
+					first := result["L"].(map[string]interface{})
+					second := first["next"].(map[string]interface{})
+
+					So(first["id"], ShouldEqual, 1)
+					So(second["ref"], ShouldEqual, "http://valid/2")
+					So(second[STOPPED_KEY], ShouldEqual, STOPPED_BY_MAX_BYTES)
+					So(usage.Fetches, ShouldEqual, 1)
+					So(usage.Bytes, ShouldEqual, int64(len(`{"id": 1, "next": {"ref": "http://valid/2"}}`)))
+				})
+
+			Convey("Expanding with ExpansionTimeoutInMs should leave the references not fetched in time as links without an error", func() {
+					singleLevel := SimpleSingleLevel{S: "root", L: Link{Ref: "http://valid/1", Rel: "next", Verb: "GET"}}
+
+					slow := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						if ref.Ref == "http://valid/1" {
+							return chain(ctx, ref)
+						}
+						<-ctx.Done()
+						return nil, ctx.Err()
+					})
+
+					expander := New(WithConfiguration(Configuration{ExpansionTimeoutInMs: 50}), WithFetcher(slow))
+					result, usage, err := expander.ExpandWithUsage(context.Background(), singleLevel, "*", "")
+					first := result["L"].(map[string]interface{})
+					second := first["next"].(map[string]interface{})
+
+					So(err, ShouldBeNil)
+					So(first["id"], ShouldEqual, 1)
+					So(second["ref"], ShouldEqual, "http://valid/2")
+					So(second[STOPPED_KEY], ShouldEqual, STOPPED_BY_DEADLINE)
+					So(usage.Skipped, ShouldEqual, 1)
+					So(usage.Elapsed, ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+				})
+
+			Convey("Expanding without limits should fetch everything and count every fetch", func() {
+					links := []Link{
+					Link{"http://valid/1", "first", "GET"},
+					Link{"http://valid/5", "second", "GET"},
+				}
+
+					expander := New(WithConfiguration(Configuration{MaxExpansionDepth: 1}), WithFetcher(chain))
+					_, usage, err := expander.ExpandWithUsage(context.Background(), SimpleWithLinks{"something", links}, "*", "")
+
+					So(err, ShouldBeNil)
+					So(usage.Fetches, ShouldEqual, 2)
+					So(usage.Skipped, ShouldEqual, 0)
+				})
+		})
+
+	Convey("It should handle non-2xx and non-JSON responses by the configured policy:", t, func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/missing":
+					w.Header().Set("Content-Type", "text/html")
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte("<html>not found</html>"))
+				case "/html":
+					w.Header().Set("Content-Type", "text/html")
+					w.Write([]byte("<html>hello</html>"))
+				default:
+					w.Header().Set("Content-Type", "application/json; charset=utf-8")
+					w.Write([]byte(`{"Name": "A name", "Age": 100}`))
+				}
+			}))
+			defer server.Close()
+
+			links := []Link{
+				Link{server.URL + "/missing", "first", "GET"},
+				Link{server.URL + "/found", "second", "GET"},
+			}
+			withLinks := SimpleWithLinks{"something", links}
+
+			Convey("Fetching a 404 should return a FetchError with the status", func() {
+					_, err := New().ExpandE(withLinks, "*", "")
+					var fetchErr *FetchError
+
+					So(errors.As(err, &fetchErr), ShouldBeTrue)
+					So(fetchErr.StatusCode, ShouldEqual, http.StatusNotFound)
+				})
+
+			Convey("Fetching a non-JSON content type should return an ErrNotJSON without decoding it", func() {
+					singleLevel := SimpleSingleLevel{S: "root", L: Link{Ref: server.URL + "/html", Rel: "page", Verb: "GET"}}
+					result, err := New().ExpandE(singleLevel, "*", "")
+
+					So(errors.Is(err, ErrNotJSON), ShouldBeTrue)
+					So(result["L"].(map[string]interface{})["ref"], ShouldEqual, server.URL+"/html")
+				})
+
+			Convey("Expanding with KEEP_LINK should leave the failing link as it is", func() {
+					result, _ := New().ExpandE(withLinks, "*", "")
+					members := result["Members"].([]interface{})
+
+					So(members[0].(Link).Ref, ShouldEqual, server.URL+"/missing")
+					So(members[1].(map[string]interface{})["Name"], ShouldEqual, "A name")
+				})
+
+			Convey("Expanding with REPLACE_WITH_NULL should replace the failing link with null", func() {
+					config := Configuration{ErrorPolicies: map[int]ErrorPolicy{4: REPLACE_WITH_NULL}}
+					result, _ := New(WithConfiguration(config)).ExpandE(withLinks, "*", "")
+					members := result["Members"].([]interface{})
+					marshalled, _ := json.Marshal(members[0])
+
+					So(string(marshalled), ShouldEqual, "null")
+					So(members[1].(map[string]interface{})["Name"], ShouldEqual, "A name")
+				})
+
+			Convey("Expanding with EMBED_ERROR should replace the failing link with an error object", func() {
+					config := Configuration{ErrorPolicies: map[int]ErrorPolicy{4: EMBED_ERROR}}
+					result, _ := New(WithConfiguration(config)).ExpandE(withLinks, "*", "")
+					embedded := result["Members"].([]interface{})[0].(map[string]interface{})
+
+					So(embedded["ref"], ShouldEqual, server.URL+"/missing")
+					So(embedded["status"], ShouldEqual, http.StatusNotFound)
+					So(embedded["message"], ShouldEqual, "Not Found")
+				})
+
+			Convey("Expanding with FAIL_EXPANSION should fail the whole expansion", func() {
+					config := Configuration{ErrorPolicies: map[int]ErrorPolicy{4: FAIL_EXPANSION}}
+					result, err := New(WithConfiguration(config)).ExpandE(withLinks, "*", "")
+					var fetchErr *FetchError
+
+					So(result, ShouldBeNil)
+					So(errors.As(err, &fetchErr), ShouldBeTrue)
+					So(fetchErr.StatusCode, ShouldEqual, http.StatusNotFound)
+				})
+
+			Convey("Expanding with a policy for another status class should not apply it", func() {
+					config := Configuration{ErrorPolicies: map[int]ErrorPolicy{5: FAIL_EXPANSION}}
+					result, err := New(WithConfiguration(config)).ExpandE(withLinks, "*", "")
+
+					So(result, ShouldNotBeNil)
+					So(err, ShouldHaveSameTypeAs, ExpansionErrors{})
+				})
+		})
+
+	Convey("It should fetch references with the verb of their link:", t, func() {
+			var calls int32
+			var methods []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				methods = append(methods, r.Method)
+				w.Header().Set("Content-Type", "application/json")
+				if r.Method != "HEAD" {
+					w.Write([]byte(`{"Name": "A name", "Age": 100}`))
+				}
+			}))
+			defer server.Close()
+
+			linkWith := func(verb string) SimpleSingleLevel {
+				return SimpleSingleLevel{L: Link{Ref: server.URL + "/search", Rel: "search", Verb: verb}}
+			}
+
+			Convey("Expanding a link without a verb should send GET", func() {
+					result := New().Expand(linkWith(""), "*", "")
+
+					So(result["L"].(map[string]interface{})["Name"], ShouldEqual, "A name")
+					So(methods, ShouldResemble, []string{"GET"})
+				})
+
+			Convey("Expanding a HEAD link should send HEAD and leave the link as it is", func() {
+					result, err := New().ExpandE(linkWith("head"), "*", "")
+
+					So(err, ShouldBeNil)
+					So(result["L"].(map[string]interface{})["ref"], ShouldEqual, server.URL+"/search")
+					So(methods, ShouldResemble, []string{"HEAD"})
+				})
+
+			Convey("Expanding a POST link should be refused unless POST is allowed", func() {
+					result, err := New().ExpandE(linkWith("POST"), "*", "")
+
+					So(errors.Is(err, ErrVerbNotAllowed), ShouldBeTrue)
+					So(result["L"].(map[string]interface{})["ref"], ShouldEqual, server.URL+"/search")
+					So(methods, ShouldBeEmpty)
+				})
+
+			Convey("Expanding a POST link with POST in AllowedVerbs should send POST without caching it", func() {
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60, AllowedVerbs: []string{"post"}}
+					expander := New(WithConfiguration(config))
+
+					expander.Expand(linkWith("POST"), "*", "")
+					result := expander.Expand(linkWith("POST"), "*", "")
+
+					So(result["L"].(map[string]interface{})["Name"], ShouldEqual, "A name")
+					So(methods, ShouldResemble, []string{"POST", "POST"})
+				})
+
+			Convey("Expanding a GET link twice with the cache should send GET only once", func() {
+					expander := New(WithConfiguration(Configuration{UsingCache: true, CacheExpInSeconds: 60}))
+
+					expander.Expand(linkWith("GET"), "*", "")
+					expander.Expand(linkWith("GET"), "*", "")
+
+					So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+				})
+		})
+
+	Convey("It should keep the configuration per Expander instance:", t, func() {
+			Convey("Expanding with two instances should resolve the references with their own IdURIs", func() {
+					simple := SimpleWithDBRef{Name: "foo", Ref: DBRef{"people", MongoId("123"), "a database"}}
+
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						uri, _ := url.Parse(ref.Ref)
+						return json.Marshal(Info{uri.Host, 100})
+					})
+
+					first := New(WithConfiguration(Configuration{UsingMongo: true, IdURIs: map[string]string{"people": "http://first/id"}}), WithFetcher(fetcher))
+					second := New(WithConfiguration(Configuration{UsingMongo: true, IdURIs: map[string]string{"people": "http://second/id"}}), WithFetcher(fetcher))
+
+					firstResult := first.Expand(simple, "*", "")
+					secondResult := second.Expand(simple, "*", "")
+
+					So(firstResult["Ref"].(map[string]interface{})["Name"], ShouldEqual, "first")
+					So(secondResult["Ref"].(map[string]interface{})["Name"], ShouldEqual, "second")
+				})
+
+			Convey("Expanding with an instance should not touch the package-level DefaultCache", func() {
+					uri := "http://instance-cache"
+					singleLevel := SimpleSingleLevel{L: Link{Ref: uri, Rel: "nothing", Verb: "GET"}}
+					info := Info{"A name", 100}
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						return json.Marshal(info)
+					})
+					expander := New(WithConfiguration(Configuration{UsingCache: true, CacheExpInSeconds: 86400}), WithCacheSize(10), WithFetcher(fetcher))
+
+					result := expander.Expand(singleLevel, "*", "")
+					actual := result["L"].(map[string]interface{})
+					_, cachedGlobally := DefaultCache.Get(uri)
+
+					So(actual["Name"], ShouldEqual, info.Name)
+					So(expander.cache.(*LRUCache).Len(), ShouldEqual, 1)
+					So(cachedGlobally, ShouldBeFalse)
+				})
+		})
 }
 
 type Link struct {
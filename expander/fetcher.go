@@ -0,0 +1,142 @@
+package expander
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Reference is a link found in the data, as given by its ref, rel and verb fields.
+type Reference struct {
+	Ref  string
+	Rel  string
+	Verb string
+}
+
+// Fetcher resolves a reference to the raw JSON of the resource behind it.
+type Fetcher interface {
+	Fetch(ctx context.Context, ref Reference) ([]byte, error)
+}
+
+// ConditionalFetcher is implemented by Fetchers that know the caching headers
+// of a resource and can revalidate it, like HTTPFetcher. The cache honors
+// those headers only for such Fetchers.
+type ConditionalFetcher interface {
+	FetchConditional(ctx context.Context, ref Reference, validators Validators) (*Response, error)
+}
+
+// Validators of a cached resource, empty ones are not sent.
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+// Response of a ConditionalFetcher. Content is empty when NotModified.
+type Response struct {
+	Content     []byte
+	Header      http.Header
+	NotModified bool
+}
+
+type FetcherFunc func(ctx context.Context, ref Reference) ([]byte, error)
+
+func (f FetcherFunc) Fetch(ctx context.Context, ref Reference) ([]byte, error) {
+	return f(ctx, ref)
+}
+
+// HTTPFetcher is the default Fetcher, it calls the ref of the link with its
+// verb and the OutboundHeaders of the context. PrepareRequest, if set, can
+// change the request before it is sent.
+type HTTPFetcher struct {
+	Client         *http.Client
+	PrepareRequest func(request *http.Request)
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, ref Reference) ([]byte, error) {
+	response, err := f.FetchConditional(ctx, ref, Validators{})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Content, nil
+}
+
+// FetchConditional sends the validators of a cached resource along, so the
+// service can answer with 304 Not Modified instead of the whole resource.
+func (f *HTTPFetcher) FetchConditional(ctx context.Context, ref Reference, validators Validators) (*Response, error) {
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	request, err := http.NewRequestWithContext(ctx, verbOf(ref), ref.Ref, nil)
+	if err != nil {
+		return nil, &FetchError{URI: ref.Ref, Err: err}
+	}
+	for name, values := range OutboundHeaders(ctx) {
+		request.Header[name] = values
+	}
+	if f.PrepareRequest != nil {
+		f.PrepareRequest(request)
+	}
+	if validators.ETag != "" {
+		request.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		request.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, &FetchError{URI: ref.Ref, Err: err}
+	}
+
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		return &Response{Header: response.Header, NotModified: true}, nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, &FetchError{URI: ref.Ref, StatusCode: response.StatusCode, Err: errors.New(http.StatusText(response.StatusCode))}
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	if !isJSONContentType(contentType) {
+		return nil, &DecodeError{URI: ref.Ref, Err: fmt.Errorf("%w, content type is '%v'", ErrNotJSON, contentType)}
+	}
+
+	contents, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, &FetchError{URI: ref.Ref, StatusCode: response.StatusCode, Err: err}
+	}
+
+	return &Response{Content: contents, Header: response.Header}, nil
+}
+
+// verbOf returns the verb of ref in upper case, GET if there is none.
+func verbOf(ref Reference) string {
+	if ref.Verb == "" {
+		return "GET"
+	}
+
+	return strings.ToUpper(ref.Verb)
+}
+
+// isJSONContentType accepts application/json, any +json type, and a missing
+// content type, which is left for the decoder to find out.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,323 @@
+package expander
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FILE_CACHE_NAME = "expander-cache.log"
+
+	// the log is compacted once it has more than this many records and
+	// more than twice as many records as entries
+	COMPACT_MIN_RECORDS = 1024
+)
+
+// FileCache keeps its entries in memory and appends every change to a log
+// file in its directory, so they are loaded again after a restart. Like
+// ShardedCache, it has no size limit.
+type FileCache struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	entries map[string]cacheEntry
+	records int
+	err     error // the last failure to write the log
+
+	bytes       int64
+	expirations int64
+}
+
+type fileCacheRecord struct {
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Expires int64  `json:",omitempty"` // in unix nanoseconds
+	Deleted bool   `json:",omitempty"`
+}
+
+// NewFileCache loads the entries logged in dir, which is created if needed.
+func NewFileCache(dir string) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &FileCache{
+		path:    filepath.Join(dir, FILE_CACHE_NAME),
+		entries: make(map[string]cacheEntry),
+	}
+	broken, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.file = file
+
+	if broken {
+		// the next record would end up on the line of the broken one
+		if err := c.compact(); err != nil {
+			c.write([]byte("\n"))
+		}
+	}
+
+	return c, nil
+}
+
+// load reads the log into the entries, and tells whether it had broken
+// records.
+func (c *FileCache) load() (bool, error) {
+	file, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	now := time.Now()
+	broken := false
+	// no Scanner, its lines are limited in size
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return broken, err
+		}
+
+		var record fileCacheRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// e.g. the last record of a crash, the rest is still good
+			broken = true
+			continue
+		}
+		c.records++
+
+		c.remove(record.Key)
+		if record.Deleted {
+			continue
+		}
+
+		entry := cacheEntry{value: record.Value}
+		if record.Expires != 0 {
+			entry.expires = time.Unix(0, record.Expires)
+		}
+		if !entry.expired(now) {
+			c.entries[record.Key] = entry
+			c.bytes += int64(len(entry.value))
+		}
+	}
+
+	return broken, nil
+}
+
+func (c *FileCache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if entry.expired(time.Now()) {
+		// no need to log it, expired entries are not loaded again
+		c.expirations++
+		c.remove(key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+func (c *FileCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := newCacheEntry(value, ttl)
+	record := fileCacheRecord{Key: key, Value: value}
+	if !entry.expires.IsZero() {
+		record.Expires = entry.expires.UnixNano()
+	}
+
+	c.remove(key)
+	c.entries[key] = entry
+	c.bytes += int64(len(value))
+	c.append(record)
+}
+
+func (c *FileCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		c.remove(key)
+		c.append(fileCacheRecord{Key: key, Deleted: true})
+	}
+}
+
+func (c *FileCache) DeletePrefix(prefix string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(key)
+			c.append(fileCacheRecord{Key: key, Deleted: true})
+		}
+	}
+}
+
+func (c *FileCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]cacheEntry)
+	c.bytes = 0
+
+	// nothing is left to compact, otherwise the entries would come back
+	// after a restart
+	if err := c.file.Truncate(0); err != nil {
+		c.err = err
+		return
+	}
+	c.records = 0
+}
+
+func (c *FileCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.entries)
+}
+
+func (c *FileCache) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return CacheStats{
+		Expirations: c.expirations,
+		Entries:     len(c.entries),
+		Bytes:       c.bytes,
+	}
+}
+
+// Err returns the last failure to write the log, nil if there was none. The
+// cache keeps working in memory, but the changes since might be lost after a
+// restart.
+func (c *FileCache) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.err
+}
+
+// Close closes the log file, the cache must not be used afterwards.
+func (c *FileCache) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.file.Close()
+}
+
+func (c *FileCache) remove(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.bytes -= int64(len(entry.value))
+		delete(c.entries, key)
+	}
+}
+
+// append logs record. The cache keeps working in memory if that fails.
+func (c *FileCache) append(record fileCacheRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	if !c.write(append(line, '\n')) {
+		return
+	}
+	c.records++
+
+	if c.records > COMPACT_MIN_RECORDS && c.records > 2*len(c.entries) {
+		c.compact()
+	}
+}
+
+func (c *FileCache) write(data []byte) bool {
+	if _, err := c.file.Write(data); err != nil {
+		c.err = err
+		return false
+	}
+
+	return true
+}
+
+// compact rewrites the log with only the entries that are still alive. The
+// old log stays as it is if that fails.
+func (c *FileCache) compact() (err error) {
+	defer func() {
+		if err != nil {
+			c.err = err
+		}
+	}()
+
+	temporary := c.path + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	records := 0
+	writer := bufio.NewWriter(file)
+	for key, entry := range c.entries {
+		if entry.expired(now) {
+			c.expirations++
+			c.remove(key)
+			continue
+		}
+
+		record := fileCacheRecord{Key: key, Value: entry.value}
+		if !entry.expires.IsZero() {
+			record.Expires = entry.expires.UnixNano()
+		}
+		line, _ := json.Marshal(record)
+		writer.Write(append(line, '\n'))
+		records++
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(temporary)
+		return err
+	}
+	file.Close()
+
+	if err := os.Rename(temporary, c.path); err != nil {
+		os.Remove(temporary)
+		return err
+	}
+
+	reopened, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	c.file.Close()
+	c.file = reopened
+	c.records = records
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package expander
+
+import (
+	"bytes"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCache(t *testing.T) {
+
+	Convey("FileCache should load its entries again after a restart:", t, func() {
+			dir := t.TempDir()
+			cache, err := NewFileCache(dir)
+			So(err, ShouldBeNil)
+
+			reopen := func() *FileCache {
+				cache.Close()
+				reopened, err := NewFileCache(dir)
+				So(err, ShouldBeNil)
+				return reopened
+			}
+
+			Convey("Reopening the cache should return the entries that were set", func() {
+					cache.Set("http://contacts/1", []byte(`{"Content": {"Name": "A name"}, "ETag": "\"v1\""}`), time.Minute)
+					cache.Set("http://contacts/2", []byte("data"), 0)
+					reopened := reopen()
+					defer reopened.Close()
+
+					first, firstCached := reopened.Get("http://contacts/1")
+					_, secondCached := reopened.Get("http://contacts/2")
+
+					So(firstCached, ShouldBeTrue)
+					So(string(first), ShouldEqual, `{"Content": {"Name": "A name"}, "ETag": "\"v1\""}`)
+					So(secondCached, ShouldBeTrue)
+				})
+
+			Convey("Reopening the cache should not return deleted or expired entries", func() {
+					cache.Set("http://contacts/1", []byte("data"), time.Minute)
+					cache.Delete("http://contacts/1")
+					cache.Set("http://contacts/2", []byte("data"), time.Millisecond)
+					cache.Set("http://groups/1", []byte("data"), time.Minute)
+					cache.DeletePrefix("http://groups/")
+					time.Sleep(2 * time.Millisecond)
+					reopened := reopen()
+					defer reopened.Close()
+
+					So(reopened.Len(), ShouldEqual, 0)
+				})
+
+			Convey("Reopening the cache should return the last value set for a key", func() {
+					cache.Set("http://contacts/1", []byte("old"), time.Minute)
+					cache.Set("http://contacts/1", []byte("new"), time.Minute)
+					reopened := reopen()
+					defer reopened.Close()
+
+					value, _ := reopened.Get("http://contacts/1")
+
+					So(string(value), ShouldEqual, "new")
+					So(reopened.Stats().Bytes, ShouldEqual, 3)
+				})
+
+			Convey("Reopening the cache should skip a broken record and keep the rest, also the records set afterwards", func() {
+					cache.Set("http://contacts/1", []byte("data"), time.Minute)
+					cache.file.Write([]byte(`{"Key": "http://contacts/2", "Val`))
+					cache = reopen()
+					cache.Set("http://contacts/3", []byte("data"), time.Minute)
+					reopened := reopen()
+					defer reopened.Close()
+
+					_, first := reopened.Get("http://contacts/1")
+					_, third := reopened.Get("http://contacts/3")
+
+					So(first, ShouldBeTrue)
+					So(third, ShouldBeTrue)
+				})
+
+			Convey("Reopening the cache should load records of any size", func() {
+					large := bytes.Repeat([]byte("a"), 65*1024*1024)
+					cache.Set("http://contacts/1", large, time.Minute)
+					cache.Set("http://contacts/2", []byte("data"), time.Minute)
+					reopened := reopen()
+					defer reopened.Close()
+
+					value, _ := reopened.Get("http://contacts/1")
+
+					So(len(value), ShouldEqual, len(large))
+					So(reopened.Len(), ShouldEqual, 2)
+				})
+
+			Convey("Reopening a purged cache should return nothing", func() {
+					cache.Set("http://contacts/1", []byte("data"), time.Minute)
+					cache.Purge()
+					reopened := reopen()
+					defer reopened.Close()
+
+					So(reopened.Len(), ShouldEqual, 0)
+					So(reopened.Err(), ShouldBeNil)
+				})
+
+			Convey("Purging should report when the log can't be emptied", func() {
+					cache.Set("http://contacts/1", []byte("data"), time.Minute)
+					cache.file.Close()
+					cache.Purge()
+
+					So(cache.Len(), ShouldEqual, 0)
+					So(cache.Err(), ShouldNotBeNil)
+				})
+
+			Convey("Setting many times should compact the log to the entries still alive", func() {
+					for i := 0; i <= COMPACT_MIN_RECORDS; i++ {
+						cache.Set("http://contacts/1", []byte(fmt.Sprintf("%v", i)), time.Minute)
+					}
+					info, _ := os.Stat(filepath.Join(dir, FILE_CACHE_NAME))
+					reopened := reopen()
+					defer reopened.Close()
+
+					value, _ := reopened.Get("http://contacts/1")
+
+					So(info.Size(), ShouldBeLessThan, 1024)
+					So(string(value), ShouldEqual, fmt.Sprintf("%v", COMPACT_MIN_RECORDS))
+				})
+		})
+}
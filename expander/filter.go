@@ -0,0 +1,381 @@
+package expander
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The filter and expansion parameters follow this grammar, whitespace between
+// the tokens is ignored:
+//
+//	filters = [ filter { "," filter } ]
+//	filter  = path | pointer
+//	path    = "-" name | "*" ":" depth | name [ "(" filters ")" | "." path ]
+//	pointer = "/" ( "-" segment | segment [ pointer ] )
+//	name    = any characters but "," "(" ")" "." ":" "/" and whitespace, not starting with "-"
+//	segment = any characters but "/" "," and, within parentheses, ")", not only digits
+//	depth   = a number greater than 0
+//
+// The children of a filter can't be empty, and a lone "*" stands for
+// everything, i.e. no Filters at all. A "-" excludes the field, see
+// Filters.Keeps. A "*" in a name matches any characters, e.g. meta_*, and
+// "**" matches its children at any depth, e.g. **.city. "*:2" stands for
+// "*(*)", i.e. every field down to 2 levels.
+//
+// a.b.c and the JSON Pointer /a/b/c both stand for a(b(c)). The segments of
+// the latter are taken as they are, e.g. /meta.version, only ~1 and ~0 stand
+// for "/" and "~". The filters of the same field are merged, so a.b,a.c
+// gives a(b,c), and a,a.b gives a, the whole field.
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenName
+	tokenComma
+	tokenOpen
+	tokenClose
+	tokenMinus
+	tokenDot
+	tokenColon
+	tokenSlash
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenName:
+		return "name"
+	case tokenComma:
+		return "','"
+	case tokenOpen:
+		return "'('"
+	case tokenClose:
+		return "')'"
+	case tokenMinus:
+		return "'-'"
+	case tokenDot:
+		return "'.'"
+	case tokenColon:
+		return "':'"
+	case tokenSlash:
+		return "'/'"
+	}
+
+	return "end of filter"
+}
+
+type token struct {
+	kind     tokenKind
+	value    string
+	position int // byte offset in the statement
+}
+
+func tokenize(statement string) []token {
+	var tokens []token
+	depth := 0
+
+	for i := 0; i < len(statement); {
+		c, size := utf8.DecodeRuneInString(statement[i:])
+		switch {
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, value: ",", position: i})
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenOpen, value: "(", position: i})
+			depth++
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenClose, value: ")", position: i})
+			depth--
+			i++
+		case unicode.IsSpace(c):
+			i += size
+		case c == '-':
+			tokens = append(tokens, token{kind: tokenMinus, value: "-", position: i})
+			i++
+		case c == '.':
+			tokens = append(tokens, token{kind: tokenDot, value: ".", position: i})
+			i++
+		case c == ':':
+			tokens = append(tokens, token{kind: tokenColon, value: ":", position: i})
+			i++
+		case c == '/':
+			tokens = append(tokens, token{kind: tokenSlash, value: "/", position: i})
+			tokens, i = appendSegment(tokens, statement, i+1, depth > 0)
+		default:
+			end := i + strings.IndexFunc(statement[i:], isDelimiter)
+			if end < i {
+				end = len(statement)
+			}
+			tokens = append(tokens, token{kind: tokenName, value: statement[i:end], position: i})
+			i = end
+		}
+	}
+
+	return append(tokens, token{kind: tokenEnd, position: len(statement)})
+}
+
+func isDelimiter(c rune) bool {
+	return c == ',' || c == '(' || c == ')' || c == '.' || c == ':' || c == '/' || unicode.IsSpace(c)
+}
+
+// appendSegment appends the tokens of the JSON Pointer segment starting at i,
+// a "-" and the name as it is, and returns where the segment ends. Within
+// parentheses, a ")" ends the segment as well.
+func appendSegment(tokens []token, statement string, i int, nested bool) ([]token, int) {
+	end := i + strings.IndexFunc(statement[i:], func(c rune) bool {
+		return c == '/' || c == ',' || (nested && c == ')')
+	})
+	if end < i {
+		end = len(statement)
+	}
+
+	// the whitespace around it is ignored, like between the other tokens
+	start := end - len(strings.TrimLeftFunc(statement[i:end], unicode.IsSpace))
+	stop := start + len(strings.TrimRightFunc(statement[start:end], unicode.IsSpace))
+	if start < stop && statement[start] == '-' {
+		tokens = append(tokens, token{kind: tokenMinus, value: "-", position: start})
+		start++
+	}
+	if start < stop {
+		tokens = append(tokens, token{kind: tokenName, value: statement[start:stop], position: start})
+	}
+
+	return tokens, end
+}
+
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// isIndex tells if the JSON Pointer segment is an array index, like the 0 of
+// /addresses/0/city.
+func isIndex(segment string) bool {
+	return segment != "" && strings.Trim(segment, "0123456789") == ""
+}
+
+type filterParser struct {
+	statement string
+	tokens    []token
+	next      int
+}
+
+// ParseFilters parses a filter or expansion parameter into its tree. Invalid
+// ones give a *FilterSyntaxError with the offset of the offending token and
+// what was expected there.
+func ParseFilters(statement string) (Filters, error) {
+	if strings.TrimSpace(statement) == "*" {
+		return nil, nil
+	}
+
+	p := &filterParser{statement: statement, tokens: tokenize(statement)}
+	if p.peek().kind == tokenEnd {
+		return nil, nil
+	}
+
+	filters, err := p.parseFilters()
+	if err != nil {
+		return nil, err
+	}
+	if found := p.peek(); found.kind != tokenEnd {
+		return nil, p.unexpected(found, "',' or end of filter")
+	}
+
+	return filters.merge(), nil
+}
+
+func (p *filterParser) parseFilters() (Filters, error) {
+	var filters Filters
+
+	for {
+		filter, err := p.parseFilter()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+
+		if p.peek().kind != tokenComma {
+			return filters, nil
+		}
+		p.next++
+	}
+}
+
+func (p *filterParser) parseFilter() (Filter, error) {
+	if p.peek().kind == tokenSlash {
+		p.next++
+		return p.parseSegment(tokenSlash)
+	}
+
+	return p.parseSegment(tokenDot)
+}
+
+// parseSegment parses a filter, and the rest of its path if separator
+// follows its name, e.g. the b.c of a.b.c or /a/b/c.
+func (p *filterParser) parseSegment(separator tokenKind) (Filter, error) {
+	exclude := p.peek().kind == tokenMinus
+	if exclude {
+		p.next++
+	}
+
+	name := p.peek()
+	if name.kind != tokenName {
+		return Filter{}, p.unexpected(name, tokenName.String())
+	}
+	p.next++
+
+	filter := Filter{Value: name.value, Exclude: exclude}
+	if separator == tokenSlash {
+		if isIndex(name.value) {
+			return Filter{}, &FilterSyntaxError{Filter: p.statement, Position: name.position, Expected: "name", Message: "array indexes are not supported, the filters of a field apply to all of its items"}
+		}
+		filter.Value = pointerUnescaper.Replace(filter.Value)
+	}
+	descendants := filter.Value == DESCENDANTS && !exclude
+
+	open := p.peek()
+	switch {
+	case open.kind == tokenColon && filter.Value == "*" && !exclude:
+		return p.parseDepth(filter)
+	case open.kind == tokenColon:
+		return Filter{}, &FilterSyntaxError{Filter: p.statement, Position: open.position, Expected: "','", Message: "only * can have a depth"}
+	case exclude && (open.kind == tokenOpen || open.kind == separator):
+		return Filter{}, &FilterSyntaxError{Filter: p.statement, Position: open.position, Expected: "','", Message: "an excluded field can't have children"}
+	case open.kind == separator:
+		p.next++
+		child, err := p.parseSegment(separator)
+		if err != nil {
+			return Filter{}, err
+		}
+		filter.Children = Filters{child}
+		return filter, nil
+	case descendants && open.kind != tokenOpen && separator == tokenSlash:
+		// there is no point in ** without children
+		return Filter{}, p.unexpected(open, separator.String())
+	case descendants && open.kind != tokenOpen:
+		return Filter{}, p.unexpected(open, fmt.Sprintf("%v or '('", separator))
+	case open.kind != tokenOpen:
+		return filter, nil
+	}
+	p.next++
+
+	children, err := p.parseFilters()
+	if err != nil {
+		return Filter{}, err
+	}
+
+	switch found := p.peek(); found.kind {
+	case tokenClose:
+		p.next++
+	case tokenEnd:
+		return Filter{}, &FilterSyntaxError{Filter: p.statement, Position: open.position, Expected: "')'", Message: "'(' is never closed"}
+	default:
+		return Filter{}, p.unexpected(found, "',' or ')'")
+	}
+
+	filter.Children = children
+	return filter, nil
+}
+
+// parseDepth parses the depth after the ':' of a "*".
+func (p *filterParser) parseDepth(filter Filter) (Filter, error) {
+	p.next++
+
+	depth := p.peek()
+	if depth.kind == tokenName {
+		filter.Depth, _ = strconv.Atoi(depth.value)
+	}
+	if filter.Depth <= 0 {
+		return Filter{}, p.unexpected(depth, "depth")
+	}
+	p.next++
+
+	if found := p.peek(); found.kind == tokenOpen {
+		return Filter{}, &FilterSyntaxError{Filter: p.statement, Position: found.position, Expected: "','", Message: "a * with a depth can't have children"}
+	}
+
+	return filter, nil
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) unexpected(found token, expected string) error {
+	what := found.kind.String()
+	if found.kind == tokenName {
+		what = fmt.Sprintf("'%v'", found.value)
+	}
+
+	return &FilterSyntaxError{
+		Filter:   p.statement,
+		Position: found.position,
+		Expected: expected,
+		Message:  fmt.Sprintf("expected %v, found %v", expected, what),
+	}
+}
+
+// merge folds the filters of the same field into one, with the children of
+// all of them, at every level. A filter without children keeps the whole
+// field, so the merged one has none either.
+func (m Filters) merge() Filters {
+	type field struct {
+		value   string
+		exclude bool
+		depth   int
+	}
+
+	var merged Filters
+	seen := make(map[field]int)
+
+	for _, filter := range m {
+		key := field{filter.Value, filter.Exclude, filter.Depth}
+		if i, ok := seen[key]; ok {
+			if merged[i].Children.IsEmpty() || filter.Children.IsEmpty() {
+				merged[i].Children = nil
+				continue
+			}
+			merged[i].Children = append(merged[i].Children[:len(merged[i].Children):len(merged[i].Children)], filter.Children...)
+			continue
+		}
+		seen[key] = len(merged)
+		merged = append(merged, filter)
+	}
+
+	for i := range merged {
+		if !merged[i].Children.IsEmpty() {
+			merged[i].Children = merged[i].Children.merge()
+		}
+	}
+
+	return merged
+}
+
+// String prints filter back in the canonical form of the grammar.
+func (f Filter) String() string {
+	if f.Exclude {
+		return "-" + f.Value
+	}
+	if f.Depth > 0 {
+		return fmt.Sprintf("%v:%v", f.Value, f.Depth)
+	}
+	if f.Children.IsEmpty() {
+		return f.Value
+	}
+
+	return f.Value + "(" + f.Children.String() + ")"
+}
+
+// String prints the filters back in the canonical form of the grammar, so
+// that parsing it gives the same tree again. That doesn't hold for the names
+// only a JSON Pointer can give, i.e. with whitespace or any of "," "(" ")"
+// "." ":" "/" in them, or starting with "-": they are printed as they are.
+func (m Filters) String() string {
+	values := make([]string, len(m))
+	for i, filter := range m {
+		values[i] = filter.String()
+	}
+
+	return strings.Join(values, ",")
+}
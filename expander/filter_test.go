@@ -0,0 +1,419 @@
+package expander
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFilterParser(t *testing.T) {
+
+	Convey("It should parse filters by their grammar:", t, func() {
+			Convey("Parsing should ignore the whitespace between the tokens", func() {
+					result, err := ParseFilters(" A , B ( C,D ) ")
+
+					So(err, ShouldBeNil)
+					So(result.String(), ShouldEqual, "A,B(C,D)")
+				})
+
+			Convey("Parsing should give no filters for * or nothing", func() {
+					for _, statement := range []string{"*", "", "  "} {
+						result, err := ParseFilters(statement)
+
+						So(err, ShouldBeNil)
+						So(result, ShouldBeEmpty)
+					}
+				})
+
+			Convey("Printing a parsed tree should give the canonical form back", func() {
+					for _, statement := range []string{"A", "A,B(C(D,E),F),G", "A(B(C(D))),E", "-A,B(-C,first-name)", "A(*(B)),meta_*", "**(city)", "*:2", "A(*:1)"} {
+						result, err := ParseFilters(statement)
+
+						So(err, ShouldBeNil)
+						So(result.String(), ShouldEqual, statement)
+					}
+				})
+		})
+
+	Convey("It should refuse filters that do not follow the grammar:", t, func() {
+			syntaxErrorOf := func(statement string) *FilterSyntaxError {
+				result, err := ParseFilters(statement)
+				So(result, ShouldBeNil)
+
+				syntaxErr, ok := err.(*FilterSyntaxError)
+				So(ok, ShouldBeTrue)
+				So(syntaxErr.Filter, ShouldEqual, statement)
+				return syntaxErr
+			}
+
+			Convey("Parsing a '(' without a name should expect a name", func() {
+					syntaxErr := syntaxErrorOf("a((b)")
+
+					So(syntaxErr.Position, ShouldEqual, 2)
+					So(syntaxErr.Expected, ShouldEqual, "name")
+				})
+
+			Convey("Parsing empty children should expect a name", func() {
+					syntaxErr := syntaxErrorOf("a()b")
+
+					So(syntaxErr.Position, ShouldEqual, 2)
+					So(syntaxErr.Expected, ShouldEqual, "name")
+				})
+
+			Convey("Parsing empty filters between commas should expect a name", func() {
+					So(syntaxErrorOf(",,").Position, ShouldEqual, 0)
+					So(syntaxErrorOf("a,").Position, ShouldEqual, 2)
+				})
+
+			Convey("Parsing filters without a comma between them should expect one", func() {
+					syntaxErr := syntaxErrorOf("a(b)c(d)")
+
+					So(syntaxErr.Position, ShouldEqual, 4)
+					So(syntaxErr.Expected, ShouldEqual, "',' or end of filter")
+					So(syntaxErr.Error(), ShouldEqual, "filter 'a(b)c(d)' is not correct at position 4: expected ',' or end of filter, found 'c'")
+				})
+
+			Convey("Parsing a '(' that is never closed should point at it", func() {
+					syntaxErr := syntaxErrorOf("a,b(c(d)")
+
+					So(syntaxErr.Position, ShouldEqual, 3)
+					So(syntaxErr.Expected, ShouldEqual, "')'")
+				})
+
+			Convey("Parsing an excluded field with children should point at the '('", func() {
+					syntaxErr := syntaxErrorOf("a,-b(c)")
+
+					So(syntaxErr.Position, ShouldEqual, 4)
+					So(syntaxErr.Message, ShouldEqual, "an excluded field can't have children")
+				})
+
+			Convey("Parsing a '-' without a name should expect a name", func() {
+					So(syntaxErrorOf("a,-").Position, ShouldEqual, 3)
+					So(syntaxErrorOf("--a").Position, ShouldEqual, 1)
+				})
+
+			Convey("Parsing ** without children should expect them", func() {
+					syntaxErr := syntaxErrorOf("a,**")
+
+					So(syntaxErr.Position, ShouldEqual, 4)
+					So(syntaxErr.Expected, ShouldEqual, "'.' or '('")
+					So(syntaxErrorOf("/**").Expected, ShouldEqual, "'/'")
+				})
+
+			Convey("Parsing a path below an excluded field should point at the separator", func() {
+					So(syntaxErrorOf("-a.b").Position, ShouldEqual, 2)
+					So(syntaxErrorOf("/-a/b").Position, ShouldEqual, 3)
+				})
+
+			Convey("Parsing a path without a name after the separator should expect one", func() {
+					So(syntaxErrorOf("a.").Position, ShouldEqual, 2)
+					So(syntaxErrorOf("/a//b").Position, ShouldEqual, 3)
+					So(syntaxErrorOf("/").Expected, ShouldEqual, "name")
+				})
+
+			Convey("Parsing a JSON Pointer with an array index should point at the index", func() {
+					syntaxErr := syntaxErrorOf("name,/addresses/0/city")
+
+					So(syntaxErr.Position, ShouldEqual, 16)
+					So(syntaxErr.Message, ShouldContainSubstring, "array indexes are not supported")
+				})
+
+			Convey("Parsing a depth that is not a number greater than 0 should expect one", func() {
+					So(syntaxErrorOf("*:").Expected, ShouldEqual, "depth")
+					So(syntaxErrorOf("*:0").Position, ShouldEqual, 2)
+					So(syntaxErrorOf("*:x").Position, ShouldEqual, 2)
+				})
+
+			Convey("Parsing a depth on anything but * should point at the ':'", func() {
+					So(syntaxErrorOf("a:2").Position, ShouldEqual, 1)
+					So(syntaxErrorOf("*:2(a)").Position, ShouldEqual, 3)
+				})
+
+			Convey("Parsing a ')' that was never opened should point at it", func() {
+					So(syntaxErrorOf("a)").Position, ShouldEqual, 1)
+					So(syntaxErrorOf("a(b))").Position, ShouldEqual, 4)
+				})
+		})
+
+	Convey("It should exclude the fields marked with '-':", t, func() {
+			data := map[string]interface{}{
+				"name":        "John Doe",
+				"description": "a very long text",
+				"addresses": []interface{}{
+					map[string]interface{}{"id": 147, "city": "Gotham City"},
+					map[string]interface{}{"id": 412, "city": "Atlantis"},
+				},
+				"group": map[string]interface{}{"id": 7, "name": "Family", "description": "My family members"},
+			}
+			filter := func(statement string) map[string]interface{} {
+				filters, err := ParseFilters(statement)
+				So(err, ShouldBeNil)
+				return walkByFilter(data, filters)
+			}
+
+			Convey("Filtering with exclusions should keep every other field", func() {
+					result := filter("-description")
+
+					So(len(result), ShouldEqual, 3)
+					So(result, ShouldNotContainKey, "description")
+					So(result["group"], ShouldResemble, data["group"])
+				})
+
+			Convey("Filtering with exclusions in a child should keep every other field of the child", func() {
+					result := filter("-description,addresses(-city),group(-description)")
+
+					So(result, ShouldNotContainKey, "description")
+					So(result["name"], ShouldEqual, "John Doe")
+					So(result["addresses"], ShouldResemble, []interface{}{
+						map[string]interface{}{"id": 147},
+						map[string]interface{}{"id": 412},
+					})
+					So(result["group"], ShouldResemble, map[string]interface{}{"id": 7, "name": "Family"})
+				})
+
+			Convey("Filtering with inclusions should keep only them, with the exclusions of their children applied", func() {
+					result := filter("addresses(-id),group(name)")
+
+					So(len(result), ShouldEqual, 2)
+					So(result["addresses"].([]interface{})[0], ShouldResemble, map[string]interface{}{"city": "Gotham City"})
+					So(result["group"], ShouldResemble, map[string]interface{}{"name": "Family"})
+				})
+
+			Convey("Excluded fields should not be expanded", func() {
+					filters, _ := ParseFilters("-group,addresses")
+
+					So(filters.Contains("group"), ShouldBeFalse)
+					So(filters.Get("group").Value, ShouldBeEmpty)
+					So(filters.Contains("addresses"), ShouldBeTrue)
+				})
+
+			Convey("Expanding * with exclusions should still expand everything", func() {
+					_, _, recursive, err := resolveFilters("*", "-description")
+
+					So(err, ShouldBeNil)
+					So(recursive, ShouldBeTrue)
+				})
+
+			Convey("Expanding * with an exclusion in a child should still expand the links next to it", func() {
+					complex := ComplexSingleLevel{
+						SSL: SimpleSingleLevel{S: "excluded", L: Link{Ref: "http://valid", Rel: "nothing", Verb: "GET"}},
+						S:   "dropped",
+					}
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						return json.Marshal(Info{"A name", 100})
+					})
+
+					result := New(WithFetcher(fetcher)).Expand(complex, "*", "SSL(-S)")
+					ssl := result["SSL"].(map[string]interface{})
+
+					So(result, ShouldNotContainKey, "S")
+					So(ssl, ShouldNotContainKey, "S")
+					So(ssl["L"].(map[string]interface{})["Name"], ShouldEqual, "A name")
+				})
+
+			Convey("Expanding * with exclusions should not fetch the links the filter drops", func() {
+					var fetched []string
+					var mutex sync.Mutex
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						mutex.Lock()
+						fetched = append(fetched, ref.Ref)
+						mutex.Unlock()
+						return json.Marshal(map[string]interface{}{"Name": ref.Ref, "Next": Link{Ref: ref.Ref + "/next", Rel: "next", Verb: "GET"}})
+					})
+					expander := New(WithFetcher(fetcher))
+					complex := ComplexSingleLevel{SSL: SimpleSingleLevel{S: "kept", L: Link{Ref: "http://valid/1", Rel: "first", Verb: "GET"}}}
+
+					Convey("An excluded link should not be fetched", func() {
+							expander.Expand(complex, "*", "SSL(-L)")
+
+							So(fetched, ShouldBeEmpty)
+						})
+
+					Convey("A link next to an exclusion, but not named at its own level, should not be fetched", func() {
+							result := expander.Expand(complex, "*", "-S,SSL(S)")
+
+							So(fetched, ShouldBeEmpty)
+							So(result["SSL"], ShouldResemble, map[string]interface{}{"S": "kept"})
+						})
+
+					Convey("An excluded link in a fetched resource should not be fetched", func() {
+							result := expander.Expand(complex, "*", "SSL(-S,L(-Next))")
+							l := result["SSL"].(map[string]interface{})["L"].(map[string]interface{})
+
+							So(fetched, ShouldResemble, []string{"http://valid/1"})
+							So(l["Name"], ShouldEqual, "http://valid/1")
+							So(l, ShouldNotContainKey, "Next")
+						})
+				})
+		})
+
+	Convey("It should match fields by patterns:", t, func() {
+			Convey("Parsing **.city should give ** with city as its child", func() {
+					filters, err := ParseFilters("**.city(name)")
+
+					So(err, ShouldBeNil)
+					So(filters.String(), ShouldEqual, "**(city(name))")
+				})
+
+			Convey("A * should match any field, and a glob the fields it matches", func() {
+					filters, _ := ParseFilters("addresses(*(name)),meta_*")
+
+					So(filters.Contains("meta_created"), ShouldBeTrue)
+					So(filters.Contains("metadata"), ShouldBeFalse)
+					So(filters.Get("addresses").Children.Contains("city"), ShouldBeTrue)
+					So(filters.Get("addresses").Children.Get("city").Children.String(), ShouldEqual, "name")
+				})
+
+			Convey("A field named by the filters should win over a pattern", func() {
+					filters, _ := ParseFilters("*(id),city(name)")
+
+					So(filters.Get("city").Children.String(), ShouldEqual, "name")
+					So(filters.Get("group").Children.String(), ShouldEqual, "id")
+				})
+
+			Convey("** should match its children at any depth", func() {
+					filters, _ := ParseFilters("**.city")
+					below := filters.Get("addresses").Children.Get("home").Children
+
+					So(filters.Contains("addresses"), ShouldBeFalse)
+					So(below.Contains("city"), ShouldBeTrue)
+					So(below.Get("city").Children.String(), ShouldEqual, "**(city)")
+				})
+
+			Convey("Filtering with ** should keep the matching fields and the way to them", func() {
+					data := map[string]interface{}{
+						"name": "John Doe",
+						"addresses": []interface{}{
+							map[string]interface{}{"id": 147, "city": map[string]interface{}{"name": "Gotham City", "id": 1}},
+						},
+						"group": map[string]interface{}{"id": 7},
+					}
+					filters, _ := ParseFilters("name,**.city(name)")
+					result := walkByFilter(data, filters)
+
+					So(result, ShouldResemble, map[string]interface{}{
+						"name": "John Doe",
+						"addresses": []interface{}{
+							map[string]interface{}{"city": map[string]interface{}{"name": "Gotham City"}},
+						},
+					})
+				})
+
+			Convey("Expanding with ** should expand only the matching links, at any depth", func() {
+					var fetched []string
+					fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						fetched = append(fetched, ref.Ref)
+						if strings.HasSuffix(ref.Ref, "/1") {
+							return []byte(`{"Name": "first", "L": {"ref": "http://valid/2"}, "O": {"ref": "http://valid/3"}}`), nil
+						}
+						return json.Marshal(Info{ref.Ref, 100})
+					})
+
+					data := ComplexSingleLevel{SSL: SimpleSingleLevel{L: Link{Ref: "http://valid/1", Rel: "first", Verb: "GET"}}}
+					result, err := New(WithFetcher(fetcher)).ExpandE(data, "**.L", "")
+					first := result["SSL"].(map[string]interface{})["L"].(map[string]interface{})
+
+					So(err, ShouldBeNil)
+					So(first["Name"], ShouldEqual, "first")
+					So(first["L"].(map[string]interface{})["Name"], ShouldEqual, "http://valid/2")
+					So(first["O"].(map[string]interface{})["ref"], ShouldEqual, "http://valid/3")
+					So(fetched, ShouldResemble, []string{"http://valid/1", "http://valid/2"})
+				})
+		})
+
+	Convey("It should expand * only down to its depth:", t, func() {
+			fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+				return []byte(fmt.Sprintf(`{"Name": "%v", "Next": {"ref": "%v/next"}}`, ref.Ref, ref.Ref)), nil
+			})
+			expander := New(WithFetcher(fetcher))
+
+			Convey("Getting the field of *:2 should give *:1 as its children", func() {
+					filters, _ := ParseFilters("*:2")
+
+					So(filters.Contains("anything"), ShouldBeTrue)
+					So(filters.Get("anything").Children.String(), ShouldEqual, "*:1")
+					So(filters.Get("anything").Children.Get("else").Children, ShouldBeEmpty)
+				})
+
+			Convey("Expanding with *:1 under a field should expand the links right under its resources", func() {
+					data := SimpleWithLinks{"something", []Link{{"http://valid/1", "member", "GET"}}}
+					result, err := expander.ExpandE(data, "Members(*:1)", "")
+					member := result["Members"].([]interface{})[0].(map[string]interface{})
+					next := member["Next"].(map[string]interface{})
+
+					So(err, ShouldBeNil)
+					So(next["Name"], ShouldEqual, "http://valid/1/next")
+					So(next["Next"].(map[string]interface{})["ref"], ShouldEqual, "http://valid/1/next/next")
+				})
+
+			Convey("Expanding with *:2 should leave the links deeper than 2 levels as they are", func() {
+					data := SimpleSingleLevel{L: Link{Ref: "http://valid/1", Rel: "first", Verb: "GET"}}
+					result, err := expander.ExpandE(data, "*:2", "")
+					next := result["L"].(map[string]interface{})["Next"].(map[string]interface{})
+
+					So(err, ShouldBeNil)
+					So(next["Name"], ShouldEqual, "http://valid/1/next")
+					So(next["Next"].(map[string]interface{})["ref"], ShouldEqual, "http://valid/1/next/next")
+				})
+		})
+
+	Convey("It should accept paths for nested filters:", t, func() {
+			Convey("Parsing dotted paths should give the same tree as parentheses", func() {
+					filters, err := ParseFilters("name,addresses.city.name")
+
+					So(err, ShouldBeNil)
+					So(filters.String(), ShouldEqual, "name,addresses(city(name))")
+				})
+
+			Convey("Parsing JSON Pointers should give the same tree as parentheses", func() {
+					filters, err := ParseFilters("/name,/addresses/city/name,/a~1b/c~0d")
+
+					So(err, ShouldBeNil)
+					So(filters.String(), ShouldEqual, "name,addresses(city(name)),a/b(c~d)")
+				})
+
+			Convey("Parsing JSON Pointers should take their segments as they are", func() {
+					filters, err := ParseFilters("/meta.version/a:b(c), /with space ,addresses(/city/name,/-id)")
+
+					So(err, ShouldBeNil)
+					So(filters[0].Value, ShouldEqual, "meta.version")
+					So(filters[0].Children[0].Value, ShouldEqual, "a:b(c)")
+					So(filters[1].Value, ShouldEqual, "with space")
+					So(filters[2].String(), ShouldEqual, "addresses(city(name),-id)")
+				})
+
+			Convey("Parsing paths of the same field should merge them", func() {
+					filters, err := ParseFilters("addresses.city.name,addresses(id),/addresses/city/id,addresses.-street")
+
+					So(err, ShouldBeNil)
+					So(filters.String(), ShouldEqual, "addresses(city(name,id),id,-street)")
+				})
+
+			Convey("Parsing a field and a path below it should keep the whole field", func() {
+					for _, statement := range []string{"addresses,addresses.city", "addresses(id),addresses", "addresses.id,/addresses,addresses(city)"} {
+						filters, err := ParseFilters(statement)
+
+						So(err, ShouldBeNil)
+						So(filters.String(), ShouldEqual, "addresses")
+					}
+				})
+
+			Convey("Filtering by a dotted path should filter like the parentheses", func() {
+					data := map[string]interface{}{
+						"name": "John Doe",
+						"cell": "+1 (312) 888-44444",
+						"addresses": []interface{}{
+							map[string]interface{}{"id": 147, "city": map[string]interface{}{"name": "Gotham City", "id": 1}},
+						},
+					}
+					byPath, _ := ParseFilters("name,addresses.city.name")
+					byParentheses, _ := ParseFilters("name,addresses(city(name))")
+
+					So(walkByFilter(data, byPath), ShouldResemble, walkByFilter(data, byParentheses))
+				})
+		})
+}
@@ -0,0 +1,114 @@
+package expander
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// VARIANT_SEPARATOR separates the URI of a cache key from the hash of the
+// ForwardHeaders it was fetched with. It cannot be part of a URI.
+const VARIANT_SEPARATOR = " "
+
+type inboundHeadersKey struct{}
+type outboundHeadersKey struct{}
+
+// WithHeaders attaches the headers of the inbound request to ctx. Only the
+// ForwardHeaders and PassThroughHeaders of the configuration are sent along
+// with the fetches of the references, and only to the ForwardHeadersTo:
+//
+//	expanded, err := expander.ExpandContext(expander.WithHeaders(r.Context(), r.Header), data, expansion, fields)
+func WithHeaders(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, inboundHeadersKey{}, header)
+}
+
+type outboundHeaders struct {
+	header  http.Header
+	variant string
+}
+
+// OutboundHeaders returns the headers to send along with the fetch of a
+// reference, for Fetchers other than HTTPFetcher.
+func OutboundHeaders(ctx context.Context) http.Header {
+	outbound, _ := ctx.Value(outboundHeadersKey{}).(outboundHeaders)
+	return outbound.header
+}
+
+// withOutboundHeaders picks the headers to forward from the inbound ones.
+// The ForwardHeaders change the response, so they are hashed into the cache
+// key, without keeping e.g. an Authorization in the cache as it is.
+func (e *Expander) withOutboundHeaders(ctx context.Context) context.Context {
+	inbound, _ := ctx.Value(inboundHeadersKey{}).(http.Header)
+	if len(inbound) == 0 {
+		return ctx
+	}
+
+	outbound := outboundHeaders{header: http.Header{}}
+	hash := sha256.New()
+	for _, name := range e.config.ForwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if values := inbound.Values(name); len(values) > 0 {
+			outbound.header[name] = values
+			fmt.Fprintf(hash, "%v: %v\n", name, strings.Join(values, ", "))
+		}
+	}
+	if len(outbound.header) > 0 {
+		outbound.variant = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	for _, name := range e.config.PassThroughHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if values := inbound.Values(name); len(values) > 0 {
+			outbound.header[name] = values
+		}
+	}
+
+	return context.WithValue(ctx, outboundHeadersKey{}, outbound)
+}
+
+// outboundHeadersFor drops the outbound headers of ctx unless ref is one of
+// the ForwardHeadersTo, so e.g. an Authorization doesn't leak to the hosts of
+// links found in a downstream response.
+func (e *Expander) outboundHeadersFor(ctx context.Context, ref Reference) context.Context {
+	if _, ok := ctx.Value(outboundHeadersKey{}).(outboundHeaders); !ok || e.sendsHeadersTo(ref) {
+		return ctx
+	}
+
+	return context.WithValue(ctx, outboundHeadersKey{}, outboundHeaders{})
+}
+
+// sendsHeadersTo tells if ref is one of the ForwardHeadersTo. Keys with a
+// scheme are URI prefixes, which have to end at a "/", "?" or "#" of ref, so
+// https://api.example.com doesn't match https://api.example.com.evil.org.
+// The others are hosts, with the port if the URI of ref has one.
+func (e *Expander) sendsHeadersTo(ref Reference) bool {
+	for _, target := range e.config.ForwardHeadersTo {
+		if !strings.Contains(target, "://") {
+			if hostOf(ref) == target {
+				return true
+			}
+			continue
+		}
+
+		rest, ok := strings.CutPrefix(ref.Ref, target)
+		if ok && (rest == "" || strings.HasSuffix(target, "/") || strings.ContainsRune("/?#", rune(rest[0]))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cacheKey is the URI of ref, followed by the hash of the ForwardHeaders of
+// ctx if there are any.
+func cacheKey(ctx context.Context, ref Reference) string {
+	outbound, _ := ctx.Value(outboundHeadersKey{}).(outboundHeaders)
+	if outbound.variant == "" {
+		return ref.Ref
+	}
+
+	return ref.Ref + VARIANT_SEPARATOR + outbound.variant
+}
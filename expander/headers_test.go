@@ -0,0 +1,134 @@
+package expander
+
+import (
+	"context"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+
+	Convey("It should forward the configured headers of the inbound request:", t, func() {
+			var calls int32
+			var correlationIds []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				correlationIds = append(correlationIds, r.Header.Get("X-Correlation-Id"))
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"user": "%v", "hooked": "%v", "cookie": "%v"}`, r.Header.Get("Authorization"), r.Header.Get("X-Hooked"), r.Header.Get("Cookie"))
+			}))
+			defer server.Close()
+
+			singleLevel := SimpleSingleLevel{L: Link{Ref: server.URL + "/contacts/1", Rel: "contact", Verb: "GET"}}
+			config := Configuration{
+				UsingCache:         true,
+				CacheExpInSeconds:  60,
+				ForwardHeaders:     []string{"authorization"},
+				PassThroughHeaders: []string{"X-Correlation-Id"},
+				ForwardHeadersTo:   []string{server.URL},
+			}
+			expander := New(WithConfiguration(config))
+
+			expandAs := func(user, correlationId string) map[string]interface{} {
+				header := http.Header{}
+				header.Set("Authorization", user)
+				header.Set("X-Correlation-Id", correlationId)
+				header.Set("Cookie", "secret")
+				result, _ := expander.ExpandContext(WithHeaders(context.Background(), header), singleLevel, "*", "")
+				return result["L"].(map[string]interface{})
+			}
+
+			Convey("Expanding should send only the ForwardHeaders and PassThroughHeaders along", func() {
+					result := expandAs("alice", "1")
+
+					So(result["user"], ShouldEqual, "alice")
+					So(result["cookie"], ShouldEqual, "")
+					So(correlationIds, ShouldResemble, []string{"1"})
+				})
+
+			Convey("Expanding as another user should not be served from the cache of the first one", func() {
+					expandAs("alice", "1")
+					result := expandAs("bob", "2")
+
+					So(result["user"], ShouldEqual, "bob")
+					So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+				})
+
+			Convey("Expanding as the same user with another PassThroughHeader should be served from the cache", func() {
+					expandAs("alice", "1")
+					result := expandAs("alice", "2")
+
+					So(result["user"], ShouldEqual, "alice")
+					So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+				})
+
+			Convey("Invalidating the URI should drop the copies of every user", func() {
+					expandAs("alice", "1")
+					expandAs("bob", "2")
+					expander.Invalidate(server.URL + "/contacts/1")
+					expandAs("alice", "3")
+					expandAs("bob", "4")
+
+					So(atomic.LoadInt32(&calls), ShouldEqual, 4)
+				})
+
+			Convey("Expanding with a request hook should let it change every request", func() {
+					hooked := New(WithRequestHook(func(request *http.Request) {
+						request.Header.Set("X-Hooked", "yes")
+					}))
+					result := hooked.Expand(singleLevel, "*", "")
+
+					So(result["L"].(map[string]interface{})["hooked"], ShouldEqual, "yes")
+				})
+
+			Convey("Expanding with a request hook should neither cache nor share the responses", func() {
+					type userKey struct{}
+					hooked := New(WithConfiguration(config), WithRequestHook(func(request *http.Request) {
+						request.Header.Set("Authorization", request.Context().Value(userKey{}).(string))
+					}))
+					expandAs := func(user string) map[string]interface{} {
+						result, _ := hooked.ExpandContext(context.WithValue(context.Background(), userKey{}, user), singleLevel, "*", "")
+						return result["L"].(map[string]interface{})
+					}
+
+					alice := expandAs("alice")
+					bob := expandAs("bob")
+
+					So(alice["user"], ShouldEqual, "alice")
+					So(bob["user"], ShouldEqual, "bob")
+					So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+				})
+
+			Convey("Expanding a link to another host should not send the headers there", func() {
+					foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Header().Set("Content-Type", "application/json")
+						fmt.Fprintf(w, `{"user": "%v", "correlation": "%v"}`, r.Header.Get("Authorization"), r.Header.Get("X-Correlation-Id"))
+					}))
+					defer foreign.Close()
+					singleLevel = SimpleSingleLevel{L: Link{Ref: foreign.URL + "/contacts/1", Rel: "contact", Verb: "GET"}}
+
+					result := expandAs("alice", "1")
+
+					So(result["user"], ShouldEqual, "")
+					So(result["correlation"], ShouldEqual, "")
+				})
+
+			Convey("Headers should only be sent to the hosts and URI prefixes they are configured for", func() {
+					targets := New(WithConfiguration(Configuration{ForwardHeadersTo: []string{"api:8080", "https://auth.example.com"}}))
+
+					So(targets.sendsHeadersTo(Reference{Ref: "http://api:8080/contacts"}), ShouldBeTrue)
+					So(targets.sendsHeadersTo(Reference{Ref: "https://auth.example.com/users?id=1"}), ShouldBeTrue)
+					So(targets.sendsHeadersTo(Reference{Ref: "https://auth.example.com.evil.org/users"}), ShouldBeFalse)
+					So(targets.sendsHeadersTo(Reference{Ref: "http://api/contacts"}), ShouldBeFalse)
+					So(New().sendsHeadersTo(Reference{Ref: "http://api:8080/contacts"}), ShouldBeFalse)
+				})
+
+			Convey("Expanding without headers should use the URI as cache key", func() {
+					So(cacheKey(expander.withOutboundHeaders(context.Background()), Reference{Ref: "http://valid"}), ShouldEqual, "http://valid")
+				})
+		})
+}
@@ -0,0 +1,103 @@
+package expander
+
+import (
+	"errors"
+	"net/http"
+)
+
+var ErrNotSupportedByCache = errors.New("not supported by the cache")
+
+// Invalidate drops the cached resource of uri, e.g. after it was changed.
+// The copies cached for different ForwardHeaders are only dropped if the
+// Cache is a PrefixDeleter.
+func (e *Expander) Invalidate(uri string) {
+	e.cache.Delete(uri)
+	if cache, ok := e.cache.(PrefixDeleter); ok {
+		cache.DeletePrefix(uri + VARIANT_SEPARATOR)
+	}
+}
+
+// InvalidatePrefix drops the cached resources of all the URIs starting with
+// prefix. It returns ErrNotSupportedByCache if the Cache is no PrefixDeleter.
+func (e *Expander) InvalidatePrefix(prefix string) error {
+	cache, ok := e.cache.(PrefixDeleter)
+	if !ok {
+		return ErrNotSupportedByCache
+	}
+
+	cache.DeletePrefix(prefix)
+	return nil
+}
+
+// Purge drops all the cached resources. It returns ErrNotSupportedByCache if
+// the Cache is no Purger.
+func (e *Expander) Purge() error {
+	cache, ok := e.cache.(Purger)
+	if !ok {
+		return ErrNotSupportedByCache
+	}
+
+	cache.Purge()
+	return nil
+}
+
+func Invalidate(uri string) {
+	defaultExpander().Invalidate(uri)
+}
+
+func InvalidatePrefix(prefix string) error {
+	return defaultExpander().InvalidatePrefix(prefix)
+}
+
+func Purge() error {
+	return defaultExpander().Purge()
+}
+
+// InvalidationHandler lets services invalidate the cache after writes:
+//
+//	DELETE ?uri=http://contacts/1     drops one resource, uri can be repeated
+//	DELETE ?prefix=http://contacts/   drops all the resources under the prefix
+//	DELETE ?all=true                  drops everything
+//
+// POST is accepted as well. It answers 204 on success.
+func (e *Expander) InvalidationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" && r.Method != "POST" {
+			w.Header().Set("Allow", "DELETE, POST")
+			http.Error(w, "only DELETE and POST are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		uris, prefixes, all := query["uri"], query["prefix"], query.Get("all") == "true"
+		if len(uris) == 0 && len(prefixes) == 0 && !all {
+			http.Error(w, "one of uri, prefix or all is required", http.StatusBadRequest)
+			return
+		}
+
+		for _, uri := range uris {
+			e.Invalidate(uri)
+		}
+		for _, prefix := range prefixes {
+			if err := e.InvalidatePrefix(prefix); err != nil {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+				return
+			}
+		}
+		if all {
+			if err := e.Purge(); err != nil {
+				http.Error(w, err.Error(), http.StatusNotImplemented)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// InvalidationHandler invalidates DefaultCache, even after it was replaced.
+func InvalidationHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultExpander().InvalidationHandler().ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+package expander
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// getSetDeleteCache hides everything but the Cache interface of its cache.
+type getSetDeleteCache struct {
+	Cache
+}
+
+func TestInvalidation(t *testing.T) {
+
+	Convey("It should invalidate the cache through the InvalidationHandler:", t, func() {
+			cache := NewLRUCache(10)
+			cache.Set("http://contacts/1", []byte("data"), time.Minute)
+			cache.Set("http://contacts/2", []byte("data"), time.Minute)
+			cache.Set("http://groups/1", []byte("data"), time.Minute)
+			handler := New(WithCache(cache)).InvalidationHandler()
+
+			call := func(method, target string) int {
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+				return recorder.Code
+			}
+
+			Convey("Calling it with uri should drop only that resource", func() {
+					status := call("DELETE", "/?uri=http://contacts/1")
+					_, firstCached := cache.Get("http://contacts/1")
+					_, secondCached := cache.Get("http://contacts/2")
+
+					So(status, ShouldEqual, http.StatusNoContent)
+					So(firstCached, ShouldBeFalse)
+					So(secondCached, ShouldBeTrue)
+				})
+
+			Convey("Calling it with prefix should drop all the resources under it", func() {
+					status := call("POST", "/?prefix=http://contacts/")
+
+					So(status, ShouldEqual, http.StatusNoContent)
+					So(cache.Len(), ShouldEqual, 1)
+				})
+
+			Convey("Calling it with all should drop everything", func() {
+					status := call("DELETE", "/?all=true")
+
+					So(status, ShouldEqual, http.StatusNoContent)
+					So(cache.Len(), ShouldEqual, 0)
+				})
+
+			Convey("Calling it without parameters should not drop anything", func() {
+					status := call("DELETE", "/")
+
+					So(status, ShouldEqual, http.StatusBadRequest)
+					So(cache.Len(), ShouldEqual, 3)
+				})
+
+			Convey("Calling it with GET should not be allowed", func() {
+					So(call("GET", "/?all=true"), ShouldEqual, http.StatusMethodNotAllowed)
+				})
+		})
+
+	Convey("It should tell when the cache cannot invalidate by prefix or purge:", t, func() {
+			expander := New(WithCache(getSetDeleteCache{NewLRUCache(10)}))
+
+			So(expander.InvalidatePrefix("http://contacts/"), ShouldEqual, ErrNotSupportedByCache)
+			So(expander.Purge(), ShouldEqual, ErrNotSupportedByCache)
+		})
+}
@@ -0,0 +1,150 @@
+package expander
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostLimit bounds the fetches sent to a host or URI prefix, unlimited where
+// a field is not set.
+type HostLimit struct {
+	MaxConcurrentFetches int     // in flight at the same time, across expansions
+	RequestsPerSecond    float64 // sustained rate of the fetches
+	Burst                int     // fetches sent at once before the rate kicks in, 1 if not set
+}
+
+type hostLimiter struct {
+	limit HostLimit
+	slots chan struct{} // nil without MaxConcurrentFetches
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newHostLimiter(limit HostLimit, now time.Time) *hostLimiter {
+	l := &hostLimiter{limit: limit, last: now}
+	if limit.MaxConcurrentFetches > 0 {
+		l.slots = make(chan struct{}, limit.MaxConcurrentFetches)
+	}
+	l.tokens = l.burst()
+
+	return l
+}
+
+func (l *hostLimiter) burst() float64 {
+	if l.limit.Burst <= 0 {
+		return 1
+	}
+
+	return float64(l.limit.Burst)
+}
+
+// acquire waits for a slot and a token, or until ctx is done. The slot is
+// taken first, so the fetches waiting for a slot don't use up the tokens.
+func (l *hostLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() {}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+			release = func() { <-l.slots }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := l.wait(ctx); err != nil {
+		release()
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// wait takes a token of the bucket, waiting until it is refilled if there is
+// none left. A token taken by a fetch that gave up is put back.
+func (l *hostLimiter) wait(ctx context.Context) error {
+	rate := l.limit.RequestsPerSecond
+	if rate <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst(), l.tokens+now.Sub(l.last).Seconds()*rate)
+	l.last = now
+	l.tokens--
+	delay := time.Duration(-l.tokens / rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mutex.Lock()
+		l.tokens++
+		l.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+type limiterGroup struct {
+	mutex    sync.Mutex
+	limiters map[string]*hostLimiter
+}
+
+func newLimiterGroup() *limiterGroup {
+	return &limiterGroup{limiters: make(map[string]*hostLimiter)}
+}
+
+// acquire waits until ref may be fetched under the limit of its host or URI
+// prefix. The returned func gives the slot back once the fetch is done.
+func (g *limiterGroup) acquire(ctx context.Context, ref Reference, limits map[string]HostLimit) (func(), error) {
+	key, ok := limitKeyOf(ref, limits)
+	if !ok {
+		return func() {}, nil
+	}
+
+	g.mutex.Lock()
+	l, ok := g.limiters[key]
+	if !ok || l.limit != limits[key] {
+		// the configuration changed, e.g. a new ExpanderConfig
+		l = newHostLimiter(limits[key], time.Now())
+		g.limiters[key] = l
+	}
+	g.mutex.Unlock()
+
+	return l.acquire(ctx)
+}
+
+// limitKeyOf returns the key of the limit ref falls under. Keys with a scheme
+// are URI prefixes, the longest one matching ref wins. The others are hosts,
+// with the port if the URI of the reference has one.
+func limitKeyOf(ref Reference, limits map[string]HostLimit) (string, bool) {
+	var prefix string
+	for key := range limits {
+		if strings.Contains(key, "://") && strings.HasPrefix(ref.Ref, key) && len(key) > len(prefix) {
+			prefix = key
+		}
+	}
+	if prefix != "" {
+		return prefix, true
+	}
+
+	host := hostOf(ref)
+	if _, ok := limits[host]; ok {
+		return host, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,137 @@
+package expander
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostLimits(t *testing.T) {
+
+	Convey("It should limit the fetches sent to a host:", t, func() {
+			var links []Link
+			for i := 0; i < 6; i++ {
+				links = append(links, Link{fmt.Sprintf("http://contacts/%v", i), "member", "GET"})
+			}
+
+			var inFlight, maxInFlight int32
+			fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+				current := atomic.AddInt32(&inFlight, 1)
+				for {
+					seen := atomic.LoadInt32(&maxInFlight)
+					if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&inFlight, -1)
+
+				return json.Marshal(Info{ref.Ref, 100})
+			})
+
+			Convey("Expanding should keep the fetches in flight within MaxConcurrentFetches of the host", func() {
+					config := Configuration{
+						MaxConcurrentFetches: 8,
+						HostLimits:           map[string]HostLimit{"contacts": {MaxConcurrentFetches: 2}},
+					}
+					result := New(WithConfiguration(config), WithFetcher(fetcher)).Expand(SimpleWithLinks{"something", links}, "*", "")
+
+					So(maxInFlight, ShouldEqual, 2)
+					So(len(result["Members"].([]interface{})), ShouldEqual, len(links))
+				})
+
+			Convey("Expanding should send the fetches no faster than RequestsPerSecond after the Burst", func() {
+					config := Configuration{
+						MaxConcurrentFetches: 8,
+						HostLimits:           map[string]HostLimit{"contacts": {RequestsPerSecond: 50, Burst: 2}},
+					}
+					started := time.Now()
+					New(WithConfiguration(config), WithFetcher(fetcher)).Expand(SimpleWithLinks{"something", links}, "*", "")
+
+					So(time.Since(started), ShouldBeGreaterThanOrEqualTo, 80*time.Millisecond)
+				})
+
+			Convey("Expanding should leave the links still waiting when the deadline passes", func() {
+					config := Configuration{
+						MaxConcurrentFetches: 8,
+						ExpansionTimeoutInMs: 50,
+						HostLimits:           map[string]HostLimit{"contacts": {RequestsPerSecond: 1}},
+					}
+					result, usage, _ := New(WithConfiguration(config), WithFetcher(fetcher)).ExpandWithUsage(context.Background(), SimpleWithLinks{"something", links}, "*", "")
+					members := result["Members"].([]interface{})
+
+					stopped := 0
+					for _, member := range members {
+						if member.(map[string]interface{})[STOPPED_KEY] == STOPPED_BY_DEADLINE {
+							stopped++
+						}
+					}
+
+					So(stopped, ShouldEqual, len(links)-1)
+					So(usage.Skipped, ShouldEqual, len(links)-1)
+				})
+
+			Convey("Expanding should not let the fetches waiting for a host hold up the other hosts", func() {
+					config := Configuration{
+						MaxConcurrentFetches: 1,
+						ExpansionTimeoutInMs: 200,
+						HostLimits:           map[string]HostLimit{"contacts": {RequestsPerSecond: 1}},
+					}
+					started := time.Now()
+					var accountFetched time.Duration
+					timed := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+						if ref.Ref == "http://accounts/1" {
+							accountFetched = time.Since(started)
+						}
+						return fetcher(ctx, ref)
+					})
+					expander := New(WithConfiguration(config), WithFetcher(timed))
+					// uses up the token, so the next fetches of the host have to wait
+					expander.Expand(SimpleWithLinks{"something", links[:1]}, "*", "")
+					members := append([]Link{{"http://accounts/1", "member", "GET"}}, links[1:]...)
+					started = time.Now()
+					expander.Expand(SimpleWithLinks{"something", members}, "*", "")
+
+					So(accountFetched, ShouldBeGreaterThan, 0)
+					So(accountFetched, ShouldBeLessThan, 100*time.Millisecond)
+				})
+
+			Convey("Expanding should not limit other hosts", func() {
+					config := Configuration{
+						MaxConcurrentFetches: 8,
+						HostLimits:           map[string]HostLimit{"accounts": {MaxConcurrentFetches: 1}},
+					}
+					New(WithConfiguration(config), WithFetcher(fetcher)).Expand(SimpleWithLinks{"something", links}, "*", "")
+
+					So(maxInFlight, ShouldBeGreaterThan, 1)
+				})
+		})
+
+	Convey("It should find the limit of a reference:", t, func() {
+			limits := map[string]HostLimit{
+				"api:8080":               {MaxConcurrentFetches: 1},
+				"http://api:8080/search": {MaxConcurrentFetches: 2},
+				"http://api:8080/":       {MaxConcurrentFetches: 3},
+			}
+
+			Convey("The longest matching URI prefix should win", func() {
+					key, _ := limitKeyOf(Reference{Ref: "http://api:8080/search?q=bob"}, limits)
+					So(key, ShouldEqual, "http://api:8080/search")
+				})
+
+			Convey("The host should be used when no prefix matches", func() {
+					key, ok := limitKeyOf(Reference{Ref: "https://api:8080/contacts"}, limits)
+					So(ok, ShouldBeTrue)
+					So(key, ShouldEqual, "api:8080")
+				})
+
+			Convey("References of other hosts should not be limited", func() {
+					_, ok := limitKeyOf(Reference{Ref: "http://other/contacts"}, limits)
+					So(ok, ShouldBeFalse)
+				})
+		})
+}
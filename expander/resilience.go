@@ -0,0 +1,219 @@
+package expander
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half-open"
+
+	DEFAULT_RETRY_BACKOFF_IN_MS    = 100
+	DEFAULT_BREAKER_COOLDOWN_IN_MS = 30000
+)
+
+// BreakerState is the state of the circuit breaker of a host.
+type BreakerState struct {
+	State    string    // BREAKER_CLOSED, BREAKER_OPEN or BREAKER_HALF_OPEN
+	Failures int       // consecutive transient failures
+	OpenedAt time.Time // zero while closed
+}
+
+type breaker struct {
+	BreakerState
+	trying bool // the one trial fetch of a half-open breaker is on its way
+}
+
+type breakerGroup struct {
+	mutex    sync.Mutex
+	breakers map[string]*breaker
+}
+
+func newBreakerGroup() *breakerGroup {
+	return &breakerGroup{breakers: make(map[string]*breaker)}
+}
+
+// allow tells if a fetch from host may be sent. An open breaker lets one
+// trial fetch through once it cooled down.
+func (g *breakerGroup) allow(host string, cooldown time.Duration, now time.Time) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	b, ok := g.breakers[host]
+	if !ok {
+		return true
+	}
+
+	switch b.State {
+	case BREAKER_OPEN:
+		if now.Sub(b.OpenedAt) < cooldown {
+			return false
+		}
+		b.State = BREAKER_HALF_OPEN
+		b.trying = true
+		return true
+	case BREAKER_HALF_OPEN:
+		if b.trying {
+			return false
+		}
+		b.trying = true
+		return true
+	}
+
+	return true
+}
+
+// record counts the outcome of a fetch from host, failed tells if it failed
+// because of the host.
+func (g *breakerGroup) record(host string, failed bool, threshold int, now time.Time) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	b, ok := g.breakers[host]
+	if !ok {
+		b = &breaker{BreakerState: BreakerState{State: BREAKER_CLOSED}}
+		g.breakers[host] = b
+	}
+	b.trying = false
+
+	if !failed {
+		b.BreakerState = BreakerState{State: BREAKER_CLOSED}
+		return
+	}
+
+	b.Failures++
+	if b.State == BREAKER_HALF_OPEN || b.Failures >= threshold {
+		b.State = BREAKER_OPEN
+		b.OpenedAt = now
+	}
+}
+
+// release gives the trial fetch back without an outcome, e.g. when the
+// caller went away.
+func (g *breakerGroup) release(host string) {
+	g.mutex.Lock()
+	if b, ok := g.breakers[host]; ok {
+		b.trying = false
+	}
+	g.mutex.Unlock()
+}
+
+func (g *breakerGroup) states() map[string]BreakerState {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	states := make(map[string]BreakerState, len(g.breakers))
+	for host, b := range g.breakers {
+		states[host] = b.BreakerState
+	}
+
+	return states
+}
+
+// Breakers returns the state of the circuit breaker of every host fetched
+// from so far.
+func (e *Expander) Breakers() map[string]BreakerState {
+	return e.breakers.states()
+}
+
+func Breakers() map[string]BreakerState {
+	return defaultExpander().Breakers()
+}
+
+// fetchResilient retries transient failures of idempotent fetches and fails
+// fast while the breaker of the host is open.
+func (e *Expander) fetchResilient(ctx context.Context, ref Reference, fetch func() (*Response, error)) (*Response, error) {
+	threshold := e.config.BreakerFailureThreshold
+	host := hostOf(ref)
+	if threshold > 0 && !e.breakers.allow(host, e.breakerCooldown(), time.Now()) {
+		return nil, &FetchError{URI: ref.Ref, Err: ErrCircuitOpen}
+	}
+
+	response, err := fetch()
+	for attempt := 0; err != nil && attempt < e.config.MaxRetries && isTransient(err) && isIdempotent(verbOf(ref)); attempt++ {
+		select {
+		case <-time.After(e.retryBackoff(attempt)):
+		case <-ctx.Done():
+			attempt = e.config.MaxRetries
+			continue
+		}
+		response, err = fetch()
+	}
+
+	if threshold > 0 {
+		if ctx.Err() != nil {
+			e.breakers.release(host)
+		} else {
+			e.breakers.record(host, err != nil && isTransient(err), threshold, time.Now())
+		}
+	}
+
+	return response, err
+}
+
+// retryBackoff doubles with each attempt, half of it is random so the
+// retries of concurrent expansions do not hit the host at the same time.
+func (e *Expander) retryBackoff(attempt int) time.Duration {
+	backoff := time.Duration(e.config.RetryBackoffInMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = DEFAULT_RETRY_BACKOFF_IN_MS * time.Millisecond
+	}
+	backoff <<= uint(attempt)
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+func (e *Expander) breakerCooldown() time.Duration {
+	if e.config.BreakerCooldownInMs <= 0 {
+		return DEFAULT_BREAKER_COOLDOWN_IN_MS * time.Millisecond
+	}
+
+	return time.Duration(e.config.BreakerCooldownInMs) * time.Millisecond
+}
+
+// isTransient tells if err might go away by trying again: network errors,
+// timeouts, 429 and 5xx. Bodies that are not JSON or a 404 will not.
+func isTransient(err error) bool {
+	if isContextError(err) && !errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		return false
+	}
+
+	switch status := fetchErr.StatusCode; {
+	case status == 0:
+		return !errors.Is(err, ErrCircuitOpen) && !errors.Is(err, ErrVerbNotAllowed) && !errors.Is(err, ErrCachedFailure)
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return true
+	default:
+		return status >= 500
+	}
+}
+
+func isIdempotent(verb string) bool {
+	switch verb {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+
+	return false
+}
+
+func hostOf(ref Reference) string {
+	uri, err := url.Parse(ref.Ref)
+	if err != nil {
+		return ref.Ref
+	}
+
+	return uri.Host
+}
@@ -0,0 +1,130 @@
+package expander
+
+import (
+	"context"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResilience(t *testing.T) {
+
+	Convey("It should retry transient failures of idempotent fetches:", t, func() {
+			var calls int32
+			status := http.StatusServiceUnavailable
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&calls, 1) < 3 {
+					w.WriteHeader(status)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"name": "Bob"}`))
+			}))
+			defer server.Close()
+
+			singleLevel := SimpleSingleLevel{L: Link{Ref: server.URL + "/contacts/1", Rel: "contact", Verb: "GET"}}
+			config := Configuration{MaxRetries: 2, RetryBackoffInMs: 1}
+
+			Convey("Expanding should succeed once a retry does", func() {
+					result, err := New(WithConfiguration(config)).ExpandE(singleLevel, "*", "")
+
+					So(err, ShouldBeNil)
+					So(result["L"].(map[string]interface{})["name"], ShouldEqual, "Bob")
+					So(atomic.LoadInt32(&calls), ShouldEqual, 3)
+				})
+
+			Convey("Expanding should give up after MaxRetries", func() {
+					config.MaxRetries = 1
+					_, err := New(WithConfiguration(config)).ExpandE(singleLevel, "*", "")
+
+					So(statusOf(err), ShouldEqual, http.StatusServiceUnavailable)
+					So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+				})
+
+			Convey("Expanding should not retry a 404", func() {
+					status = http.StatusNotFound
+					_, err := New(WithConfiguration(config)).ExpandE(singleLevel, "*", "")
+
+					So(statusOf(err), ShouldEqual, http.StatusNotFound)
+					So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+				})
+
+			Convey("Expanding should not retry a POST", func() {
+					config.AllowedVerbs = []string{"POST"}
+					search := SimpleSingleLevel{L: Link{Ref: server.URL + "/search", Rel: "search", Verb: "POST"}}
+					New(WithConfiguration(config)).ExpandE(search, "*", "")
+
+					So(atomic.LoadInt32(&calls), ShouldEqual, 1)
+				})
+		})
+
+	Convey("It should open the circuit breaker of a host after repeated failures:", t, func() {
+			var calls int32
+			var healthy int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				if atomic.LoadInt32(&healthy) == 0 {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"name": "Bob"}`))
+			}))
+			defer server.Close()
+
+			singleLevel := SimpleSingleLevel{L: Link{Ref: server.URL + "/contacts/1", Rel: "contact", Verb: "GET"}}
+			config := Configuration{BreakerFailureThreshold: 2, BreakerCooldownInMs: 50}
+			expander := New(WithConfiguration(config))
+			host := server.Listener.Addr().String()
+
+			expander.ExpandE(singleLevel, "*", "")
+			expander.ExpandE(singleLevel, "*", "")
+
+			Convey("Expanding while it is open should leave the link without calling the host", func() {
+					result, err := expander.ExpandE(singleLevel, "*", "")
+
+					So(errors.Is(err, ErrCircuitOpen), ShouldBeTrue)
+					So(result["L"].(map[string]interface{})["ref"], ShouldEqual, singleLevel.L.Ref)
+					So(atomic.LoadInt32(&calls), ShouldEqual, 2)
+					So(expander.Breakers()[host].State, ShouldEqual, BREAKER_OPEN)
+					So(expander.Breakers()[host].Failures, ShouldEqual, 2)
+				})
+
+			Convey("Expanding after the cooldown should close it again if the trial fetch succeeds", func() {
+					atomic.StoreInt32(&healthy, 1)
+					time.Sleep(60 * time.Millisecond)
+					result, err := expander.ExpandE(singleLevel, "*", "")
+
+					So(err, ShouldBeNil)
+					So(result["L"].(map[string]interface{})["name"], ShouldEqual, "Bob")
+					So(expander.Breakers()[host].State, ShouldEqual, BREAKER_CLOSED)
+				})
+
+			Convey("Expanding after the cooldown should open it again if the trial fetch fails", func() {
+					time.Sleep(60 * time.Millisecond)
+					expander.ExpandE(singleLevel, "*", "")
+
+					So(atomic.LoadInt32(&calls), ShouldEqual, 3)
+					So(expander.Breakers()[host].State, ShouldEqual, BREAKER_OPEN)
+				})
+		})
+
+	Convey("It should tell transient failures apart:", t, func() {
+			Convey("Network errors, timeouts, 429 and 5xx should be transient", func() {
+					So(isTransient(&FetchError{URI: "http://valid", Err: errors.New("connection refused")}), ShouldBeTrue)
+					So(isTransient(&FetchError{URI: "http://valid", StatusCode: http.StatusTooManyRequests}), ShouldBeTrue)
+					So(isTransient(&FetchError{URI: "http://valid", StatusCode: http.StatusInternalServerError}), ShouldBeTrue)
+				})
+
+			Convey("4xx, bodies that are not JSON, open breakers and cancellation should not", func() {
+					So(isTransient(&FetchError{URI: "http://valid", StatusCode: http.StatusNotFound}), ShouldBeFalse)
+					So(isTransient(&DecodeError{URI: "http://valid", Err: ErrNotJSON}), ShouldBeFalse)
+					So(isTransient(&FetchError{URI: "http://valid", Err: ErrCircuitOpen}), ShouldBeFalse)
+					So(isTransient(&FetchError{URI: "http://valid", Err: context.Canceled}), ShouldBeFalse)
+				})
+		})
+}
@@ -0,0 +1,79 @@
+package expander
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync/atomic"
+)
+
+// CacheStats tell how well the reference cache works. Misses include the
+// references answered by a cached failure, StaleServes the expired entries
+// served while revalidating or when refreshing them failed. Evictions,
+// Expirations, Entries and Bytes come from the Cache, if it is a
+// StatsReporter.
+type CacheStats struct {
+	Hits        int64
+	Misses      int64
+	StaleServes int64
+	Evictions   int64
+	Expirations int64
+	Entries     int
+	Bytes       int64
+}
+
+// StatsReporter is implemented by Caches that count what happens inside them.
+type StatsReporter interface {
+	Stats() CacheStats
+}
+
+type cacheStats struct {
+	hits        int64
+	misses      int64
+	staleServes int64
+}
+
+func (e *Expander) Stats() CacheStats {
+	var stats CacheStats
+	if cache, ok := e.cache.(StatsReporter); ok {
+		stats = cache.Stats()
+	}
+
+	stats.Hits = atomic.LoadInt64(&e.stats.hits)
+	stats.Misses = atomic.LoadInt64(&e.stats.misses)
+	stats.StaleServes = atomic.LoadInt64(&e.stats.staleServes)
+	return stats
+}
+
+// StatsHandler serves the Stats as JSON.
+func (e *Expander) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.Stats())
+	})
+}
+
+// PublishStats publishes the Stats as an expvar under name. Like
+// expvar.Publish, it panics if name is already in use.
+func (e *Expander) PublishStats(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return e.Stats()
+	}))
+}
+
+func Stats() CacheStats {
+	return defaultExpander().Stats()
+}
+
+// StatsHandler serves the Stats of DefaultCache, even after it was replaced.
+func StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultExpander().StatsHandler().ServeHTTP(w, r)
+	})
+}
+
+func PublishStats(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return Stats()
+	}))
+}
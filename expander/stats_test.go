@@ -0,0 +1,64 @@
+package expander
+
+import (
+	"context"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+
+	Convey("It should count what happens in the reference cache:", t, func() {
+			fetcher := FetcherFunc(func(ctx context.Context, ref Reference) ([]byte, error) {
+				return json.Marshal(Info{"A name", 100})
+			})
+			singleLevel := SimpleSingleLevel{L: Link{Ref: "http://valid/stats", Rel: "nothing", Verb: "GET"}}
+
+			Convey("Expanding the same reference twice should count a miss and a hit", func() {
+					expander := New(WithConfiguration(Configuration{UsingCache: true, CacheExpInSeconds: 60}), WithFetcher(fetcher))
+					expander.Expand(singleLevel, "*", "")
+					expander.Expand(singleLevel, "*", "")
+					stats := expander.Stats()
+
+					So(stats.Misses, ShouldEqual, 1)
+					So(stats.Hits, ShouldEqual, 1)
+					So(stats.Entries, ShouldEqual, 1)
+					So(stats.Bytes, ShouldBeGreaterThan, 0)
+				})
+
+			Convey("Expanding an expired entry with CacheStaleWhileRevalidateInSeconds should count a stale serve", func() {
+					cache := NewLRUCache(10)
+					expired, _ := json.Marshal(cachedResource{Content: []byte(`{"Name": "old"}`), FreshUntil: time.Now().Add(-time.Second)})
+					cache.Set("http://valid/stats", expired, time.Minute)
+					config := Configuration{UsingCache: true, CacheExpInSeconds: 60, CacheStaleWhileRevalidateInSeconds: 60}
+
+					expander := New(WithConfiguration(config), WithCache(cache), WithFetcher(fetcher))
+					expander.Expand(singleLevel, "*", "")
+
+					So(expander.Stats().StaleServes, ShouldEqual, 1)
+				})
+
+			Convey("Expanding without the cache should not count anything", func() {
+					expander := New(WithFetcher(fetcher))
+					expander.Expand(singleLevel, "*", "")
+
+					So(expander.Stats(), ShouldResemble, CacheStats{})
+				})
+
+			Convey("Calling the StatsHandler should return the stats as JSON", func() {
+					expander := New(WithConfiguration(Configuration{UsingCache: true, CacheExpInSeconds: 60}), WithFetcher(fetcher))
+					expander.Expand(singleLevel, "*", "")
+
+					recorder := httptest.NewRecorder()
+					expander.StatsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+					var stats CacheStats
+					json.Unmarshal(recorder.Body.Bytes(), &stats)
+
+					So(recorder.Header().Get("Content-Type"), ShouldEqual, "application/json")
+					So(stats, ShouldResemble, expander.Stats())
+				})
+		})
+}